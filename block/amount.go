@@ -0,0 +1,144 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount 金額を最小単位(1コインの10^-8)の整数で表します。
+type Amount int64
+
+const (
+	AmountDecimals        = 8
+	Coin           Amount = 100000000 // 1コイン
+	// MaxAmount 1つのトランザクションのValueとFee、UTXOの出力に使える額の上限です(合意のルール)。
+	// 2つを足してもint64の範囲を超えないよう、十分に小さくしています。
+	MaxAmount Amount = 10000000000 * Coin
+)
+
+var ErrAmountOverflow = errors.New("amount overflows")
+
+// SumAmounts amountsの合計を返します。途中でint64の範囲を超える場合はErrAmountOverflowを返します。
+func SumAmounts(amounts ...Amount) (Amount, error) {
+	var sum Amount
+	for _, a := range amounts {
+		if (a > 0 && sum > math.MaxInt64-a) || (a < 0 && sum < math.MinInt64-a) {
+			return 0, ErrAmountOverflow
+		}
+		sum += a
+	}
+	return sum, nil
+}
+
+// ValidAmount トランザクションの額として使える範囲(0以上MaxAmount以下)か返します。
+func ValidAmount(a Amount) bool {
+	return a >= 0 && a <= MaxAmount
+}
+
+// ParseAmount "1.25"のような10進数の文字列をAmountに変換します。小数点以下はAmountDecimals桁までです。
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(fracPart) > AmountDecimals {
+		return 0, fmt.Errorf("amount %q has more than %d decimals", s, AmountDecimals)
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+	fracPart += strings.Repeat("0", AmountDecimals-len(fracPart))
+	whole, err := strconv.ParseUint(intPart, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	frac, err := strconv.ParseUint(fracPart, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if whole > uint64(math.MaxInt64/int64(Coin)) || whole*uint64(Coin)+frac > math.MaxInt64 {
+		return 0, fmt.Errorf("amount %q is too large", s)
+	}
+	a := Amount(whole)*Coin + Amount(frac)
+	if negative {
+		a = -a
+	}
+	return a, nil
+}
+
+// AmountFromFloat 以前のfloat32の金額(コイン単位)を最も近いAmountに変換します。
+func AmountFromFloat(f float64) (Amount, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > float64(math.MaxInt64/int64(Coin)) {
+		return 0, fmt.Errorf("invalid amount %v", f)
+	}
+	return Amount(math.Round(f * float64(Coin))), nil
+}
+
+// String 末尾のゼロを省いた10進数の文字列を返します。
+func (a Amount) String() string {
+	sign := ""
+	u := uint64(a)
+	if a < 0 {
+		sign = "-"
+		u = uint64(-a)
+	}
+	whole := u / uint64(Coin)
+	frac := u % uint64(Coin)
+	if frac == 0 {
+		return fmt.Sprintf("%s%d", sign, whole)
+	}
+	fracStr := strings.TrimRight(fmt.Sprintf("%0*d", AmountDecimals, frac), "0")
+	return fmt.Sprintf("%s%d.%s", sign, whole, fracStr)
+}
+
+// MarshalJSON 丸め誤差が出ないように10進数の文字列として出力します。
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON 10進数の文字列に加えて、以前の形式のJSONの数値(コイン単位)も受け付けます。
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		v, err := ParseAmount(s)
+		if err != nil {
+			return err
+		}
+		*a = v
+		return nil
+	}
+	if v, err := ParseAmount(string(data)); err == nil {
+		*a = v
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	v, err := AmountFromFloat(f)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
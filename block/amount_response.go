@@ -2,14 +2,22 @@ package block
 
 import "encoding/json"
 
+// AmountResponse Amountは承認済みの残高、Availableはプールにある送金を差し引いた使える額、
+// Pendingはプールのトランザクションが全て承認された場合の残高です。
 type AmountResponse struct {
-	Amount float32 `json:"amount"`
+	Amount    Amount `json:"amount"`
+	Available Amount `json:"available_amount"`
+	Pending   Amount `json:"pending_amount"`
 }
 
 func (ar *AmountResponse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Amount float32 `json:"amount"`
+		Amount    Amount `json:"amount"`
+		Available Amount `json:"available_amount"`
+		Pending   Amount `json:"pending_amount"`
 	}{
-		Amount: ar.Amount,
+		Amount:    ar.Amount,
+		Available: ar.Available,
+		Pending:   ar.Pending,
 	})
 }
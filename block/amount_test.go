@@ -0,0 +1,137 @@
+package block
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		err  bool
+	}{
+		{in: "1", want: Coin},
+		{in: "0.1", want: Coin / 10},
+		{in: ".5", want: Coin / 2},
+		{in: "+2", want: 2 * Coin},
+		{in: "-2.5", want: -2*Coin - Coin/2},
+		{in: "1.23456789", want: 123456789},
+		{in: " 3 ", want: 3 * Coin},
+		{in: "92233720368.54775807", want: math.MaxInt64},
+		{in: "92233720368.54775808", err: true},
+		{in: "92233720368.99999999", err: true},
+		{in: "92233720369", err: true},
+		{in: "0.123456789", err: true},
+		{in: "", err: true},
+		{in: ".", err: true},
+		{in: "1e-3", err: true},
+		{in: "abc", err: true},
+		{in: "1.-5", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseAmount(%q) = %d, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0"},
+		{Coin, "1"},
+		{Coin / 10, "0.1"},
+		{1, "0.00000001"},
+		{-Coin - Coin/4, "-1.25"},
+		{math.MaxInt64, "92233720368.54775807"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+		back, err := ParseAmount(tt.want)
+		if err != nil || back != tt.in {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", tt.want, back, err, tt.in)
+		}
+	}
+}
+
+func TestAmountUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{`"1.5"`, Coin + Coin/2},
+		{`0.1`, Coin / 10},
+		{`1e-3`, Coin / 1000},
+	}
+	for _, tt := range tests {
+		var a Amount
+		if err := a.UnmarshalJSON([]byte(tt.in)); err != nil || a != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, %v, want %d", tt.in, a, err, tt.want)
+		}
+	}
+	var a Amount
+	if err := a.UnmarshalJSON([]byte(`"92233720368.99999999"`)); err == nil {
+		t.Errorf("UnmarshalJSON accepted an amount that overflows: %d", a)
+	}
+}
+
+func TestSumAmounts(t *testing.T) {
+	tests := []struct {
+		in   []Amount
+		want Amount
+		err  bool
+	}{
+		{in: nil, want: 0},
+		{in: []Amount{Coin, 2 * Coin}, want: 3 * Coin},
+		{in: []Amount{math.MaxInt64, -1, 1}, want: math.MaxInt64},
+		{in: []Amount{5000000000000000000, 5000000000000000000}, err: true},
+		{in: []Amount{math.MaxInt64, 1}, err: true},
+		{in: []Amount{math.MinInt64, -1}, err: true},
+		{in: []Amount{1 << 62, 1 << 62, 1 << 62, 1 << 62}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := SumAmounts(tt.in...)
+		if tt.err {
+			if err == nil {
+				t.Errorf("SumAmounts(%v) = %d, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("SumAmounts(%v) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyBlockTransactionsAmountLimits(t *testing.T) {
+	tests := []struct {
+		value, fee Amount
+		rule       string
+	}{
+		{value: 5000000000000000000, fee: 5000000000000000000, rule: RuleFee},
+		{value: MaxAmount + 1, fee: 0, rule: RuleValue},
+		{value: Coin, fee: -1, rule: RuleFee},
+	}
+	for _, tt := range tests {
+		tx := NewTransaction("alice", "bob", tt.value)
+		tx.Fee = tt.fee
+		b := NewBlock(0, [32]byte{}, 0, []*Transaction{tx})
+		err := verifyBlockTransactions(1, b, Coin, newAccountState(), nil)
+		cve, ok := err.(*ChainValidationError)
+		if !ok || cve.Rule != tt.rule {
+			t.Errorf("value %d fee %d: got %v, want rule %s", tt.value, tt.fee, err, tt.rule)
+		}
+	}
+}
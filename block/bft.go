@@ -0,0 +1,621 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const ConsensusBFT = "bft" // Tendermint方式のBFT
+
+// RuleCommit BFTでブロックを確定させたプレコミットに関するルールです。
+const RuleCommit = "commit"
+
+// bftTickInterval BFTのラウンドを進める間隔です。
+const bftTickInterval = 100 * time.Millisecond
+
+// 隣接ノードからの提案と投票を受け付ける、自ノードより先の高さとラウンドの範囲です。
+// これより先のものは記録せず、高さが先の場合はチェーンの同期だけを行います。
+const (
+	maxBFTHeightsAhead = 1024
+	maxBFTRoundsAhead  = 64
+)
+
+var (
+	errBFTValidators = errors.New("bft: no validators configured")
+	errBFTLedger     = errors.New("bft: requires an account ledger")
+	ErrBFTSeal       = errors.New("bft: blocks are committed by validator rounds")
+	ErrNotBFT        = errors.New("chain does not use bft consensus")
+)
+
+// BFT 決まったバリデーター(ChainConfig.Authorities)が提案、プレボート、プレコミットのラウンドで合意する方式です。
+// 高さheightのラウンドroundではAuthorities[(height+round)%n]がブロックを提案し、2/3を超えるバリデーターの
+// プレボートが集まったブロックにプレコミットします。2/3を超えるプレコミットが集まったブロックはCommitを付けて
+// チェーンに追加され、確定します。確定したブロックはResolveConflictsでも置き換えません。
+// プレコミットしたバリデーターはそのブロックにロックし、それより後のラウンドで別のブロックに2/3を超える
+// プレボートが集まるまで、ほかのブロックにはプレボートしません。ラウンドがタイムアウトすると次の提案者に移ります。
+type BFT struct {
+	config *ChainConfig
+
+	mux          sync.Mutex
+	running      bool
+	height       int
+	round        int
+	roundStart   time.Time
+	proposals    map[int]*Block                      // ラウンドごとの提案
+	votes        map[string]map[int]map[string]*Vote // 種類、ラウンド、バリデーターのアドレスごとの投票
+	proposed     map[int]bool
+	prevoted     map[int]bool
+	precommitted map[int]bool
+	lockedBlock  *Block
+	lockedRound  int
+	lastSync     time.Time
+}
+
+// bftMessage 隣接ノードに送るBFTのメッセージです。ロックを外してから送ります。
+type bftMessage struct {
+	path string
+	body []byte
+}
+
+func newBFT(config *ChainConfig) (Consensus, error) {
+	if len(config.Authorities) == 0 {
+		return nil, errBFTValidators
+	}
+	if config.UTXO() {
+		return nil, errBFTLedger
+	}
+	return &BFT{config: config, height: -1}, nil
+}
+
+func init() {
+	RegisterConsensus(ConsensusBFT, newBFT)
+}
+
+func (e *BFT) Name() string {
+	return ConsensusBFT
+}
+
+// Quorum ブロックの確定に必要な投票数(バリデーター数の2/3を超える最小の数)です。
+func (e *BFT) Quorum() int {
+	return len(e.config.Authorities)*2/3 + 1
+}
+
+func (e *BFT) isValidator(address string) bool {
+	for _, a := range e.config.Authorities {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// maxFaulty 合意を保ったまま許せる故障したバリデーターの数f(バリデーター数 >= 3f+1)です。
+func (e *BFT) maxFaulty() int {
+	return (len(e.config.Authorities) - 1) / 3
+}
+
+// Proposer 高さheightのラウンドroundでブロックを提案するバリデーターです。heightとroundは0以上です。
+// 大きな値でも足し算があふれないよう、それぞれの余りから求めます。
+func (e *BFT) Proposer(height int, round int) string {
+	n := len(e.config.Authorities)
+	return e.config.Authorities[(height%n+round%n)%n]
+}
+
+func (e *BFT) Prepare(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	header.Difficulty = 0
+	if height == 0 {
+		header.Timestamp = genesisTimestamp
+	}
+	return nil
+}
+
+// Seal BFTのブロックはバリデーターのラウンドで確定するので、1つのノードだけでは作れません。
+func (e *BFT) Seal(bc *Blockchain, tmpl *BlockTemplate) (*Block, error) {
+	return nil, ErrBFTSeal
+}
+
+func (e *BFT) VerifyHeader(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	if header.Difficulty != 0 || header.Nonce != 0 {
+		return blockError(height, RuleDifficulty, "bft blocks must have zero difficulty and nonce")
+	}
+	if height == 0 {
+		if header.Signer != nil || header.Signature != nil {
+			return blockError(height, RuleGenesis, "genesis block must not be signed")
+		}
+		return nil
+	}
+	signer, ok := verifyHeaderSignature(header)
+	if !ok {
+		return blockError(height, RuleSigner, "missing or invalid block signature")
+	}
+	if !e.isValidator(signer) {
+		return blockError(height, RuleSigner, "%s is not a validator", signer)
+	}
+	return nil
+}
+
+// VerifyBlock ブロックが2/3を超えるバリデーターのプレコミットで確定しているか確認します。
+func (e *BFT) VerifyBlock(height int, b *Block) error {
+	if height == 0 {
+		return nil
+	}
+	c := b.Commit
+	if c == nil {
+		return blockError(height, RuleCommit, "block has no commit")
+	}
+	hash := b.Hash()
+	voted := make(map[string]bool, len(c.Precommits))
+	for _, v := range c.Precommits {
+		if v.Type != VotePrecommit || v.Height != height || v.Round != c.Round || v.BlockHash != hash {
+			return blockError(height, RuleCommit, "precommit is not for this block and round")
+		}
+		validator, ok := v.Verify()
+		if !ok {
+			return blockError(height, RuleCommit, "invalid precommit signature")
+		}
+		if !e.isValidator(validator) {
+			return blockError(height, RuleCommit, "%s is not a validator", validator)
+		}
+		voted[validator] = true
+	}
+	if len(voted) < e.Quorum() {
+		return blockError(height, RuleCommit, "%d precommits, need %d", len(voted), e.Quorum())
+	}
+	return nil
+}
+
+// VerifySeal ヘッダーがいずれかのバリデーターの正しい署名を持つか確認します。
+func (e *BFT) VerifySeal(header *BlockHeader) error {
+	signer, ok := verifyHeaderSignature(header)
+	if !ok {
+		return errors.New("missing or invalid block signature")
+	}
+	if !e.isValidator(signer) {
+		return fmt.Errorf("%s is not a validator", signer)
+	}
+	return nil
+}
+
+func (e *BFT) Weight(header *BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// IsFinal Commitを持つブロックは確定しています。チェーンに入ったブロックのCommitはVerifyBlockで検証済みです。
+func (e *BFT) IsFinal(b *Block) bool {
+	return b.Commit != nil
+}
+
+// Run bftTickIntervalごとにラウンドを進めます。StartMiningから呼ばれます。
+func (e *BFT) Run(bc *Blockchain) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.running {
+		return
+	}
+	e.running = true
+	go func() {
+		for range time.Tick(bftTickInterval) {
+			e.mux.Lock()
+			e.syncHeight(bc)
+			if time.Since(e.roundStart) > e.roundTimeout() {
+				e.round++
+				e.roundStart = time.Now()
+				log.Printf("blockchain: action=bft_round, height=%d, round=%d, proposer=%s", e.height, e.round, e.Proposer(e.height, e.round))
+			}
+			out := e.advance(bc)
+			e.mux.Unlock()
+			bc.broadcastBFT(out)
+		}
+	}()
+}
+
+// roundTimeout ラウンドの長さです。ラウンドが進むほど長くして、遅いノードも追いつけるようにします。
+func (e *BFT) roundTimeout() time.Duration {
+	return blockPeriod(e.config) * time.Duration(e.round+1)
+}
+
+// syncHeight チェーンの高さが変わっていたら、次の高さのラウンド0から始めます。
+// 最初のラウンドは親ブロックからBlockPeriodSecが経つまで始めません。
+func (e *BFT) syncHeight(bc *Blockchain) {
+	height := bc.chain.Height()
+	if height == e.height {
+		return
+	}
+	e.height = height
+	e.round = 0
+	e.roundStart = time.Now()
+	if start := time.Unix(0, bc.LastBlock().Timestamp).Add(blockPeriod(e.config)); start.After(e.roundStart) {
+		e.roundStart = start
+	}
+	e.proposals = make(map[int]*Block)
+	e.votes = map[string]map[int]map[string]*Vote{VotePrevote: {}, VotePrecommit: {}}
+	e.proposed = make(map[int]bool)
+	e.prevoted = make(map[int]bool)
+	e.precommitted = make(map[int]bool)
+	e.lockedBlock = nil
+	e.lockedRound = -1
+}
+
+// count ラウンドroundでblockHashに投票したバリデーターの数です。
+func (e *BFT) count(voteType string, round int, blockHash [32]byte) int {
+	n := 0
+	for _, v := range e.votes[voteType][round] {
+		if v.BlockHash == blockHash {
+			n++
+		}
+	}
+	return n
+}
+
+// polkaRound blockHashに2/3を超えるプレボートが集まった最も新しいラウンドです。なければ-1です。
+func (e *BFT) polkaRound(blockHash [32]byte) int {
+	for round := e.round; round >= 0; round-- {
+		if e.count(VotePrevote, round, blockHash) >= e.Quorum() {
+			return round
+		}
+	}
+	return -1
+}
+
+// validatorsInRound ラウンドroundでプレボートかプレコミットをしたバリデーターの数です。
+// 1つのバリデーターが両方に投票しても1と数えます。
+func (e *BFT) validatorsInRound(round int) int {
+	seen := make(map[string]bool)
+	for _, voteType := range []string{VotePrevote, VotePrecommit} {
+		for validator := range e.votes[voteType][round] {
+			seen[validator] = true
+		}
+	}
+	return len(seen)
+}
+
+// recordVote 投票を記録します。同じバリデーターの同じラウンドの2つ目以降の投票は無視します。
+func (e *BFT) recordVote(validator string, v *Vote) {
+	rounds := e.votes[v.Type]
+	if rounds[v.Round] == nil {
+		rounds[v.Round] = make(map[string]*Vote)
+	}
+	if _, ok := rounds[v.Round][validator]; !ok {
+		rounds[v.Round][validator] = v
+	}
+}
+
+// vote keyで投票して記録し、隣接ノードに送るメッセージを返します。
+func (e *BFT) vote(key *ecdsa.PrivateKey, voteType string, blockHash [32]byte) []bftMessage {
+	v, err := NewVote(key, voteType, e.height, e.round, blockHash)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return nil
+	}
+	e.recordVote(utils.AddressFromPublicKey(&key.PublicKey), v)
+	m, _ := v.MarshalJSON()
+	return []bftMessage{{path: "bft/vote", body: m}}
+}
+
+// advance 今のラウンドで自ノードができること(提案、プレボート、プレコミット、確定)を順に行います。
+func (e *BFT) advance(bc *Blockchain) []bftMessage {
+	key := bc.Signer()
+	if key == nil || time.Now().Before(e.roundStart) {
+		return nil
+	}
+	me := utils.AddressFromPublicKey(&key.PublicKey)
+	if !e.isValidator(me) {
+		return nil
+	}
+	var out []bftMessage
+
+	if e.Proposer(e.height, e.round) == me && !e.proposed[e.round] {
+		e.proposed[e.round] = true
+		// ロックしているブロックがあれば、新しいブロックの代わりにそれを提案します。
+		b := e.lockedBlock
+		if b == nil {
+			var err error
+			if b, err = bc.newBFTBlock(key); err != nil {
+				log.Printf("ERROR: %v", err)
+				return out
+			}
+		}
+		v, err := NewVote(key, VoteProposal, e.height, e.round, b.Hash())
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return out
+		}
+		e.proposals[e.round] = b
+		m, _ := (&Proposal{Vote: v, Block: b}).MarshalJSON()
+		out = append(out, bftMessage{path: "bft/proposal", body: m})
+	}
+
+	if p := e.proposals[e.round]; p != nil && !e.prevoted[e.round] {
+		e.prevoted[e.round] = true
+		hash := p.Hash()
+		if e.lockedBlock != nil && e.lockedBlock.Hash() != hash && e.polkaRound(hash) <= e.lockedRound {
+			log.Printf("blockchain: action=bft_prevote, status=locked, height=%d, round=%d", e.height, e.round)
+		} else if err := bc.checkNextBlock(e.height, p); err != nil {
+			log.Printf("blockchain: action=bft_prevote, status=invalid, height=%d, round=%d, error=%v", e.height, e.round, err)
+		} else {
+			out = append(out, e.vote(key, VotePrevote, hash)...)
+		}
+	}
+
+	if p := e.proposals[e.round]; p != nil && !e.precommitted[e.round] && e.count(VotePrevote, e.round, p.Hash()) >= e.Quorum() {
+		e.precommitted[e.round] = true
+		e.lockedBlock, e.lockedRound = p, e.round
+		out = append(out, e.vote(key, VotePrecommit, p.Hash())...)
+	}
+
+	for round, p := range e.proposals {
+		hash := p.Hash()
+		if e.count(VotePrecommit, round, hash) < e.Quorum() {
+			continue
+		}
+		committed := *p
+		committed.Commit = &Commit{Round: round}
+		for _, v := range e.votes[VotePrecommit][round] {
+			if v.BlockHash == hash {
+				committed.Commit.Precommits = append(committed.Commit.Precommits, v)
+			}
+		}
+		if err := bc.commitBFTBlock(e.height, &committed); err != nil {
+			log.Printf("ERROR: %v", err)
+			continue
+		}
+		log.Printf("blockchain: action=bft_commit, status=success, height=%d, round=%d, precommits=%d, transactions=%d",
+			e.height, round, len(committed.Commit.Precommits), len(committed.Transactions))
+		e.syncHeight(bc)
+		break
+	}
+	return out
+}
+
+// checkVoteRange 高さとラウンドが負でないか確認します。Proposerなどで使う前に確認します。
+func checkVoteRange(height int, round int) error {
+	if height < 0 || round < 0 {
+		return fmt.Errorf("negative height %d or round %d", height, round)
+	}
+	return nil
+}
+
+// receive 隣接ノードからのメッセージの高さとラウンドを確認し、今の高さのものであればtrueを返します。
+// 自ノードより先の高さであればチェーンを同期します。先の高さやラウンドが離れすぎている場合はエラーを返します。
+func (e *BFT) receive(bc *Blockchain, height int, round int) (bool, error) {
+	e.syncHeight(bc)
+	if height > e.height && time.Since(e.lastSync) > blockPeriod(e.config) {
+		e.lastSync = time.Now()
+		go bc.ResolveConflicts()
+	}
+	if height > e.height+maxBFTHeightsAhead {
+		return false, fmt.Errorf("height %d is too far ahead of %d", height, e.height)
+	}
+	if height != e.height {
+		return false, nil
+	}
+	if round > e.round+maxBFTRoundsAhead {
+		return false, fmt.Errorf("round %d is too far ahead of %d", round, e.round)
+	}
+	return true, nil
+}
+
+func (e *BFT) receiveProposal(bc *Blockchain, p *Proposal) ([]bftMessage, error) {
+	if p.Vote == nil || p.Block == nil || p.Vote.Type != VoteProposal {
+		return nil, fmt.Errorf("malformed proposal")
+	}
+	if err := checkVoteRange(p.Vote.Height, p.Vote.Round); err != nil {
+		return nil, err
+	}
+	proposer, ok := p.Vote.Verify()
+	if !ok {
+		return nil, fmt.Errorf("invalid proposal signature")
+	}
+	if expected := e.Proposer(p.Vote.Height, p.Vote.Round); proposer != expected {
+		return nil, fmt.Errorf("proposal from %s, expected %s", proposer, expected)
+	}
+	if p.Block.Hash() != p.Vote.BlockHash {
+		return nil, fmt.Errorf("proposal signature is not for the block")
+	}
+	sealer, ok := verifyHeaderSignature(p.Block.Header())
+	if !ok {
+		return nil, fmt.Errorf("proposed block has no valid signature")
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if ok, err := e.receive(bc, p.Vote.Height, p.Vote.Round); !ok {
+		return nil, err
+	}
+	// 他のバリデーターが封印したブロックは、前のラウンドで2/3を超えるプレボートを集めたブロック(ロックしたブロック)の
+	// 再提案としてだけ受け付けます。それ以外は別のバリデーターのブロックを中継しただけの提案です。
+	if sealer != proposer {
+		if round := e.polkaRound(p.Vote.BlockHash); round < 0 || round >= p.Vote.Round {
+			return nil, fmt.Errorf("proposed block is sealed by %s, not the proposer %s", sealer, proposer)
+		}
+	}
+	if _, ok := e.proposals[p.Vote.Round]; !ok {
+		e.proposals[p.Vote.Round] = p.Block
+	}
+	return e.advance(bc), nil
+}
+
+func (e *BFT) receiveVote(bc *Blockchain, v *Vote) ([]bftMessage, error) {
+	if v.Type != VotePrevote && v.Type != VotePrecommit {
+		return nil, fmt.Errorf("unknown vote type %q", v.Type)
+	}
+	if err := checkVoteRange(v.Height, v.Round); err != nil {
+		return nil, err
+	}
+	validator, ok := v.Verify()
+	if !ok {
+		return nil, fmt.Errorf("invalid vote signature")
+	}
+	if !e.isValidator(validator) {
+		return nil, fmt.Errorf("%s is not a validator", validator)
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if ok, err := e.receive(bc, v.Height, v.Round); !ok {
+		return nil, err
+	}
+	e.recordVote(validator, v)
+	// 先のラウンドにf+1以上のバリデーター(少なくとも1つは正しいバリデーター)が進んでいれば、
+	// タイムアウトを待たずにそのラウンドに移ります。
+	if v.Round > e.round && e.validatorsInRound(v.Round) >= e.maxFaulty()+1 {
+		e.round = v.Round
+		e.roundStart = time.Now()
+	}
+	return e.advance(bc), nil
+}
+
+// BFTStatus GET /bft/status BFTのラウンドの状態です。
+type BFTStatus struct {
+	Height      int
+	Round       int
+	Proposer    string
+	LockedRound int
+	Prevotes    int
+	Precommits  int
+	Quorum      int
+}
+
+func (s *BFTStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Height      int    `json:"height"`
+		Round       int    `json:"round"`
+		Proposer    string `json:"proposer"`
+		LockedRound int    `json:"locked_round"`
+		Prevotes    int    `json:"prevotes"`
+		Precommits  int    `json:"precommits"`
+		Quorum      int    `json:"quorum"`
+	}{
+		Height:      s.Height,
+		Round:       s.Round,
+		Proposer:    s.Proposer,
+		LockedRound: s.LockedRound,
+		Prevotes:    s.Prevotes,
+		Precommits:  s.Precommits,
+		Quorum:      s.Quorum,
+	})
+}
+
+// BFTStatus 今の高さとラウンド、そのラウンドで集まった投票の数を返します。
+func (bc *Blockchain) BFTStatus() (*BFTStatus, error) {
+	e, ok := bc.engine.(*BFT)
+	if !ok {
+		return nil, ErrNotBFT
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.syncHeight(bc)
+	return &BFTStatus{
+		Height:      e.height,
+		Round:       e.round,
+		Proposer:    e.Proposer(e.height, e.round),
+		LockedRound: e.lockedRound,
+		Prevotes:    len(e.votes[VotePrevote][e.round]),
+		Precommits:  len(e.votes[VotePrecommit][e.round]),
+		Quorum:      e.Quorum(),
+	}, nil
+}
+
+// ReceiveProposal 隣接ノードから届いた提案を記録し、ラウンドを進めます。
+func (bc *Blockchain) ReceiveProposal(p *Proposal) error {
+	e, ok := bc.engine.(*BFT)
+	if !ok {
+		return ErrNotBFT
+	}
+	out, err := e.receiveProposal(bc, p)
+	bc.broadcastBFT(out)
+	return err
+}
+
+// ReceiveVote 隣接ノードから届いた投票を記録し、ラウンドを進めます。
+func (bc *Blockchain) ReceiveVote(v *Vote) error {
+	e, ok := bc.engine.(*BFT)
+	if !ok {
+		return ErrNotBFT
+	}
+	out, err := e.receiveVote(bc, v)
+	bc.broadcastBFT(out)
+	return err
+}
+
+// newBFTBlock プールのトランザクションからブロックを作り、keyで署名します。
+func (bc *Blockchain) newBFTBlock(key *ecdsa.PrivateKey) (*Block, error) {
+	tmpl, err := bc.NewBlockTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if err := signHeader(key, &tmpl.Header); err != nil {
+		return nil, err
+	}
+	return tmpl.Block(0), nil
+}
+
+// checkNextBlock bが現在の先頭に続く高さheightのブロックとして正しいか、トランザクションまで検証します。
+func (bc *Blockchain) checkNextBlock(height int, b *Block) error {
+	if bc.chain.Height() != height {
+		return fmt.Errorf("block for height %d, chain is at %d", height, bc.chain.Height())
+	}
+	parent := bc.LastBlock()
+	if b.PreviousHash != parent.Hash() {
+		return blockError(height, RulePreviousHash, "does not link to block %d", height-1)
+	}
+	if b.Config != nil {
+		return blockError(height, RuleGenesis, "only the genesis block may carry a chain config")
+	}
+	if b.Timestamp <= parent.Timestamp {
+		return blockError(height, RuleTimestamp, "timestamp %d is not after parent %d", b.Timestamp, parent.Timestamp)
+	}
+	if b.Timestamp > time.Now().Add(MaxFutureBlockTimeSec*time.Second).UnixNano() {
+		return blockError(height, RuleTimestamp, "timestamp %d is too far in the future", b.Timestamp)
+	}
+	if b.MerkleRoot != TransactionsMerkleRoot(b.Transactions) {
+		return blockError(height, RuleMerkleRoot, "merkle root does not match transactions")
+	}
+	if size := transactionsSize(b.Transactions); size > MaxBlockSize {
+		return blockError(height, RuleBlockSize, "transactions are %d bytes, limit is %d", size, MaxBlockSize)
+	}
+	if err := bc.engine.VerifyHeader(bc.storedBlockAt, height, b.Header()); err != nil {
+		return err
+	}
+	return verifyBlockTransactions(height, b, bc.config.BlockReward(height), bc.state.clone(), nil)
+}
+
+// commitBFTBlock プレコミットで確定したブロックをチェーンに追加します。
+func (bc *Blockchain) commitBFTBlock(height int, b *Block) error {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if err := bc.checkNextBlock(height, b); err != nil {
+		return err
+	}
+	if err := bc.verifyBlock(height, b); err != nil {
+		return err
+	}
+	if bc.addBlock(b) == nil {
+		return fmt.Errorf("could not store block %d", height)
+	}
+	return nil
+}
+
+// broadcastBFT メッセージを隣接ノードに送ります。応答を待たないよう、ノードごとに別のゴルーチンで送ります。
+func (bc *Blockchain) broadcastBFT(messages []bftMessage) {
+	for _, msg := range messages {
+		for _, n := range bc.neighbors {
+			go func(n string, msg bftMessage) {
+				endpoint := fmt.Sprintf("http://%s/%s", n, msg.path)
+				resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(msg.body))
+				if err != nil {
+					log.Printf("ERROR: %v", err)
+					return
+				}
+				resp.Body.Close()
+			}(n, msg)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"math"
+	"testing"
+)
+
+// newTestBFT n個のバリデーターのBFTのチェーンと、バリデーターの鍵を返します。
+func newTestBFT(t *testing.T, n int) (*Blockchain, *BFT, []*ecdsa.PrivateKey) {
+	t.Helper()
+	config := DefaultChainConfig()
+	config.Consensus = ConsensusBFT
+	config.BlockPeriodSec = 1
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < n; i++ {
+		key, address := newTestKey(t)
+		keys = append(keys, key)
+		config.Authorities = append(config.Authorities, address)
+	}
+	bc, err := NewBlockchainWithStore("", 0, NewMemoryBlockStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc, bc.engine.(*BFT), keys
+}
+
+func TestBFTQuorum(t *testing.T) {
+	tests := []struct {
+		validators, quorum, faulty int
+	}{
+		{1, 1, 0},
+		{3, 3, 0},
+		{4, 3, 1},
+		{5, 4, 1},
+		{7, 5, 2},
+		{10, 7, 3},
+	}
+	for _, tt := range tests {
+		e := &BFT{config: &ChainConfig{Authorities: make([]string, tt.validators)}}
+		if got := e.Quorum(); got != tt.quorum {
+			t.Errorf("%d validators: Quorum() = %d, want %d", tt.validators, got, tt.quorum)
+		}
+		if got := e.maxFaulty(); got != tt.faulty {
+			t.Errorf("%d validators: maxFaulty() = %d, want %d", tt.validators, got, tt.faulty)
+		}
+		// 2つのクォーラムは必ず正しいバリデーターを1つ以上共有します
+		if overlap := 2*tt.quorum - tt.validators; overlap <= tt.faulty {
+			t.Errorf("%d validators: quorums overlap in %d, faulty %d", tt.validators, overlap, tt.faulty)
+		}
+	}
+}
+
+func TestBFTProposer(t *testing.T) {
+	e := &BFT{config: &ChainConfig{Authorities: []string{"a", "b", "c", "d"}}}
+	tests := []struct {
+		height, round int
+		want          string
+	}{
+		{0, 0, "a"},
+		{1, 0, "b"},
+		{1, 1, "c"},
+		{3, 2, "b"},
+		{math.MaxInt64, 0, "d"},
+		{math.MaxInt64, math.MaxInt64, "c"},
+	}
+	for _, tt := range tests {
+		if got := e.Proposer(tt.height, tt.round); got != tt.want {
+			t.Errorf("Proposer(%d, %d) = %q, want %q", tt.height, tt.round, got, tt.want)
+		}
+	}
+}
+
+// TestBFTRoundSkip 1つのバリデーターがプレボートとプレコミットを両方送っても先のラウンドに移らず、
+// f+1(4つのバリデーターでは2)のバリデーターが揃ったときだけ移ることを確認します。
+func TestBFTRoundSkip(t *testing.T) {
+	bc, e, keys := newTestBFT(t, 4)
+	height := bc.chain.Height()
+	send := func(key *ecdsa.PrivateKey, voteType string, round int) {
+		t.Helper()
+		v, err := NewVote(key, voteType, height, round, [32]byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.receiveVote(bc, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(keys[0], VotePrevote, 5)
+	send(keys[0], VotePrecommit, 5)
+	if e.round != 0 {
+		t.Fatalf("one validator moved the round to %d", e.round)
+	}
+	send(keys[1], VotePrevote, 5)
+	if e.round != 5 {
+		t.Fatalf("round = %d after two validators, want 5", e.round)
+	}
+}
+
+func TestBFTRejectsOutOfRangeMessages(t *testing.T) {
+	bc, e, keys := newTestBFT(t, 4)
+	height := bc.chain.Height()
+	tests := []struct {
+		name          string
+		height, round int
+	}{
+		{"negative round", height, -1},
+		{"negative height", -1, 0},
+		{"most negative round", height, math.MinInt64},
+		{"far future round", height, maxBFTRoundsAhead + 1},
+		{"maximum round", height, math.MaxInt64},
+		{"far future height", height + maxBFTHeightsAhead + 1, 0},
+	}
+	for _, tt := range tests {
+		v, err := NewVote(keys[0], VotePrevote, tt.height, tt.round, [32]byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.receiveVote(bc, v); err == nil {
+			t.Errorf("%s: vote was accepted", tt.name)
+		}
+		p, err := NewVote(keys[0], VoteProposal, tt.height, tt.round, [32]byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.receiveProposal(bc, &Proposal{Vote: p, Block: &Block{}}); err == nil {
+			t.Errorf("%s: proposal was accepted", tt.name)
+		}
+	}
+	if e.round != 0 {
+		t.Errorf("out-of-range messages moved the round to %d", e.round)
+	}
+}
+
+func TestBFTVerifyBlockCommit(t *testing.T) {
+	_, e, keys := newTestBFT(t, 4)
+	b := NewBlock(0, [32]byte{}, 0, nil)
+	precommit := func(key *ecdsa.PrivateKey) *Vote {
+		v, err := NewVote(key, VotePrecommit, 1, 0, b.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	b.Commit = &Commit{Round: 0, Precommits: []*Vote{precommit(keys[0]), precommit(keys[1])}}
+	if err := e.VerifyBlock(1, b); err == nil {
+		t.Error("block with 2 of 4 precommits was accepted")
+	}
+	// 同じバリデーターのプレコミットを重ねてもクォーラムにはなりません
+	b.Commit.Precommits = append(b.Commit.Precommits, precommit(keys[1]))
+	if err := e.VerifyBlock(1, b); err == nil {
+		t.Error("duplicate precommits were counted twice")
+	}
+	b.Commit.Precommits = append(b.Commit.Precommits, precommit(keys[2]))
+	if err := e.VerifyBlock(1, b); err != nil {
+		t.Errorf("block with 3 of 4 precommits: %v", err)
+	}
+}
+
+// TestBFTProposalSealer 提案者以外が封印したブロックの提案は、前のラウンドでクォーラムのプレボートを集めた
+// ブロックの再提案でない限り受け付けないことを確認します。
+func TestBFTProposalSealer(t *testing.T) {
+	bc, e, keys := newTestBFT(t, 4)
+	height := bc.chain.Height()
+	keyOf := func(address string) *ecdsa.PrivateKey {
+		for i, a := range e.config.Authorities {
+			if a == address {
+				return keys[i]
+			}
+		}
+		t.Fatalf("%s is not a validator", address)
+		return nil
+	}
+	propose := func(proposer *ecdsa.PrivateKey, round int, b *Block) error {
+		t.Helper()
+		v, err := NewVote(proposer, VoteProposal, height, round, b.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = e.receiveProposal(bc, &Proposal{Vote: v, Block: b})
+		return err
+	}
+	proposer := keyOf(e.Proposer(height, 0))
+	next := keyOf(e.Proposer(height, 1))
+	relayed, err := bc.newBFTBlock(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := propose(proposer, 0, relayed); err == nil {
+		t.Fatal("accepted a proposal of a block sealed by another validator")
+	}
+	own, err := bc.newBFTBlock(proposer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := propose(proposer, 0, own); err != nil {
+		t.Fatal(err)
+	}
+
+	// ラウンド0の提案にクォーラムのプレボートが集まると、次のラウンドの提案者はそれを再提案できます
+	for _, key := range keys[:e.Quorum()] {
+		v, err := NewVote(key, VotePrevote, height, 0, own.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.receiveVote(bc, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := propose(next, 1, own); err != nil {
+		t.Errorf("re-proposal of the polka block: %v", err)
+	}
+	if err := propose(keyOf(e.Proposer(height, 2)), 2, relayed); err == nil {
+		t.Error("accepted a relayed block without a polka")
+	}
+}
@@ -0,0 +1,166 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// BFTの投票の種類です。提案も提案者が署名した投票として送ります。
+const (
+	VoteProposal  = "proposal"
+	VotePrevote   = "prevote"
+	VotePrecommit = "precommit"
+)
+
+// Vote BFTのバリデーターが高さとラウンドごとにブロックのハッシュに対して署名した投票です。
+type Vote struct {
+	Type      string
+	Height    int
+	Round     int
+	BlockHash [32]byte
+	Validator *ecdsa.PublicKey
+	Signature *utils.Signature
+}
+
+// NewVote keyで署名した投票を作成します。
+func NewVote(key *ecdsa.PrivateKey, voteType string, height int, round int, blockHash [32]byte) (*Vote, error) {
+	v := &Vote{Type: voteType, Height: height, Round: round, BlockHash: blockHash, Validator: &key.PublicKey}
+	h := v.SigningHash()
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		return nil, err
+	}
+	v.Signature = &utils.Signature{R: r, S: s}
+	return v, nil
+}
+
+// SigningHash 署名の対象になるハッシュです。
+func (v *Vote) SigningHash() [32]byte {
+	m, _ := json.Marshal(struct {
+		Type      string `json:"type"`
+		Height    int    `json:"height"`
+		Round     int    `json:"round"`
+		BlockHash string `json:"block_hash"`
+	}{
+		Type:      v.Type,
+		Height:    v.Height,
+		Round:     v.Round,
+		BlockHash: fmt.Sprintf("%x", v.BlockHash),
+	})
+	return sha256.Sum256(m)
+}
+
+// Verify 署名を検証し、投票したバリデーターのアドレスを返します。
+func (v *Vote) Verify() (string, bool) {
+	if v.Validator == nil || v.Signature == nil || v.Signature.R == nil || v.Signature.S == nil {
+		return "", false
+	}
+	h := v.SigningHash()
+	if !ecdsa.Verify(v.Validator, h[:], v.Signature.R, v.Signature.S) {
+		return "", false
+	}
+	return utils.AddressFromPublicKey(v.Validator), true
+}
+
+func (v *Vote) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type      string `json:"type"`
+		Height    int    `json:"height"`
+		Round     int    `json:"round"`
+		BlockHash string `json:"block_hash"`
+		Validator string `json:"validator"`
+		Signature string `json:"signature"`
+	}{
+		Type:      v.Type,
+		Height:    v.Height,
+		Round:     v.Round,
+		BlockHash: fmt.Sprintf("%x", v.BlockHash),
+		Validator: publicKeyHex(v.Validator),
+		Signature: signatureHex(v.Signature),
+	})
+}
+
+func (v *Vote) UnmarshalJSON(data []byte) error {
+	var blockHash, validator, signature string
+	w := &struct {
+		Type      *string `json:"type"`
+		Height    *int    `json:"height"`
+		Round     *int    `json:"round"`
+		BlockHash *string `json:"block_hash"`
+		Validator *string `json:"validator"`
+		Signature *string `json:"signature"`
+	}{
+		Type:      &v.Type,
+		Height:    &v.Height,
+		Round:     &v.Round,
+		BlockHash: &blockHash,
+		Validator: &validator,
+		Signature: &signature,
+	}
+	if err := json.Unmarshal(data, w); err != nil {
+		return err
+	}
+	if err := decodeHash(blockHash, &v.BlockHash); err != nil {
+		return err
+	}
+	return decodeSigner(validator, signature, &v.Validator, &v.Signature)
+}
+
+// Commit ブロックを確定させた、同じラウンドの2/3を超えるバリデーターのプレコミットです。
+// ブロックのハッシュには含まれず、ブロックと一緒に保存されます。
+type Commit struct {
+	Round      int
+	Precommits []*Vote
+}
+
+func (c *Commit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Round      int     `json:"round"`
+		Precommits []*Vote `json:"precommits"`
+	}{
+		Round:      c.Round,
+		Precommits: c.Precommits,
+	})
+}
+
+func (c *Commit) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		Round      *int     `json:"round"`
+		Precommits *[]*Vote `json:"precommits"`
+	}{
+		Round:      &c.Round,
+		Precommits: &c.Precommits,
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Proposal ラウンドの提案者が送るブロックと、その提案への署名です。
+type Proposal struct {
+	Vote  *Vote
+	Block *Block
+}
+
+func (p *Proposal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Vote  *Vote  `json:"vote"`
+		Block *Block `json:"block"`
+	}{
+		Vote:  p.Vote,
+		Block: p.Block,
+	})
+}
+
+func (p *Proposal) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		Vote  **Vote  `json:"vote"`
+		Block **Block `json:"block"`
+	}{
+		Vote:  &p.Vote,
+		Block: &p.Block,
+	}
+	return json.Unmarshal(data, v)
+}
@@ -1,6 +1,8 @@
 package block
 
 import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -11,15 +13,23 @@ import (
 type Block struct {
 	Timestamp    int64
 	Nonce        int
+	Difficulty   int
 	PreviousHash [32]byte
+	MerkleRoot   [32]byte
+	Config       *ChainConfig     // ジェネシスブロックのみ
+	Signer       *ecdsa.PublicKey // 署名でブロックを封印する合意の方式(PoAなど)のみ
+	Signature    *utils.Signature
 	Transactions []*Transaction
+	Commit       *Commit // BFTのみ。ブロックを確定させたプレコミットで、ハッシュには含みません
 }
 
-func NewBlock(nonce int, previousHash [32]byte, transactions []*Transaction) *Block {
+func NewBlock(nonce int, previousHash [32]byte, difficulty int, transactions []*Transaction) *Block {
 	return &Block{
 		Timestamp:    time.Now().UnixNano(),
 		Nonce:        nonce,
+		Difficulty:   difficulty,
 		PreviousHash: previousHash,
+		MerkleRoot:   TransactionsMerkleRoot(transactions),
 		Transactions: transactions,
 	}
 }
@@ -27,48 +37,228 @@ func NewBlock(nonce int, previousHash [32]byte, transactions []*Transaction) *Bl
 func (b *Block) Print() {
 	fmt.Printf("timestamp       %d\n", b.Timestamp)
 	fmt.Printf("nonce           %d\n", b.Nonce)
+	fmt.Printf("difficulty      %d\n", b.Difficulty)
 	fmt.Printf("previous_hash   %x\n", b.PreviousHash)
+	fmt.Printf("merkle_root     %x\n", b.MerkleRoot)
+	if b.Signature != nil {
+		fmt.Printf("signature       %s\n", b.Signature)
+	}
 	for _, t := range b.Transactions {
 		t.Print()
 	}
 }
 
+// Header トランザクション本体を除いたブロックヘッダーを返します。
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		Timestamp:    b.Timestamp,
+		Nonce:        b.Nonce,
+		Difficulty:   b.Difficulty,
+		PreviousHash: b.PreviousHash,
+		MerkleRoot:   b.MerkleRoot,
+		Config:       b.Config,
+		Signer:       b.Signer,
+		Signature:    b.Signature,
+	}
+}
+
+// Hash ブロックヘッダーのハッシュを返します。トランザクションはMerkleRootを通してのみハッシュに含まれます。
 func (b *Block) Hash() [32]byte {
-	m, _ := json.Marshal(b)
-	return sha256.Sum256([]byte(m))
+	return b.Header().Hash()
 }
 
 func (b *Block) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Timestamp    int64          `json:"timestamp"`
 		Nonce        int            `json:"nonce"`
+		Difficulty   int            `json:"difficulty"`
 		PreviousHash string         `json:"previousHash"`
+		MerkleRoot   string         `json:"merkleRoot"`
+		Config       *ChainConfig   `json:"config,omitempty"`
+		Signer       string         `json:"signer,omitempty"`
+		Signature    string         `json:"signature,omitempty"`
 		Transactions []*Transaction `json:"transactions"`
+		Commit       *Commit        `json:"commit,omitempty"`
 	}{
 		Timestamp:    b.Timestamp,
 		Nonce:        b.Nonce,
+		Difficulty:   b.Difficulty,
 		PreviousHash: fmt.Sprintf("%x", b.PreviousHash),
+		MerkleRoot:   fmt.Sprintf("%x", b.MerkleRoot),
+		Config:       b.Config,
+		Signer:       publicKeyHex(b.Signer),
+		Signature:    signatureHex(b.Signature),
 		Transactions: b.Transactions,
+		Commit:       b.Commit,
 	})
 }
 
 func (b *Block) UnmarshalJSON(data []byte) error {
 	var previousHash string
+	var merkleRoot string
+	var signer, signature string
 	v := &struct {
 		Timestamp    *int64          `json:"timestamp"`
 		Nonce        *int            `json:"nonce"`
+		Difficulty   *int            `json:"difficulty"`
 		PreviousHash *string         `json:"previousHash"`
+		MerkleRoot   *string         `json:"merkleRoot"`
+		Config       **ChainConfig   `json:"config"`
+		Signer       *string         `json:"signer"`
+		Signature    *string         `json:"signature"`
 		Transactions *[]*Transaction `json:"transactions"`
+		Commit       **Commit        `json:"commit"`
 	}{
 		Timestamp:    &b.Timestamp,
 		Nonce:        &b.Nonce,
+		Difficulty:   &b.Difficulty,
 		PreviousHash: &previousHash,
+		MerkleRoot:   &merkleRoot,
+		Config:       &b.Config,
+		Signer:       &signer,
+		Signature:    &signature,
 		Transactions: &b.Transactions,
+		Commit:       &b.Commit,
 	}
 	if err := json.Unmarshal(data, v); err != nil {
 		return err
 	}
-	ph, _ := hex.DecodeString(previousHash)
-	copy(b.PreviousHash[:], ph[:32])
+	if err := decodeHash(previousHash, &b.PreviousHash); err != nil {
+		return err
+	}
+	if err := decodeSigner(signer, signature, &b.Signer, &b.Signature); err != nil {
+		return err
+	}
+	return decodeHash(merkleRoot, &b.MerkleRoot)
+}
+
+// BlockHeader ブロックのハッシュとプルーフオブワークの対象になる部分です。
+type BlockHeader struct {
+	Timestamp    int64
+	Nonce        int
+	Difficulty   int
+	PreviousHash [32]byte
+	MerkleRoot   [32]byte
+	Config       *ChainConfig
+	Signer       *ecdsa.PublicKey
+	Signature    *utils.Signature
+}
+
+func (h *BlockHeader) Hash() [32]byte {
+	m, _ := json.Marshal(h)
+	return sha256.Sum256([]byte(m))
+}
+
+// SealHash 封印の署名の対象になるハッシュです。署名自体を除いたヘッダーのハッシュです。
+func (h *BlockHeader) SealHash() [32]byte {
+	unsigned := *h
+	unsigned.Signature = nil
+	return unsigned.Hash()
+}
+
+func (h *BlockHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Timestamp    int64        `json:"timestamp"`
+		Nonce        int          `json:"nonce"`
+		Difficulty   int          `json:"difficulty"`
+		PreviousHash string       `json:"previousHash"`
+		MerkleRoot   string       `json:"merkleRoot"`
+		Config       *ChainConfig `json:"config,omitempty"`
+		Signer       string       `json:"signer,omitempty"`
+		Signature    string       `json:"signature,omitempty"`
+	}{
+		Timestamp:    h.Timestamp,
+		Nonce:        h.Nonce,
+		Difficulty:   h.Difficulty,
+		PreviousHash: fmt.Sprintf("%x", h.PreviousHash),
+		MerkleRoot:   fmt.Sprintf("%x", h.MerkleRoot),
+		Config:       h.Config,
+		Signer:       publicKeyHex(h.Signer),
+		Signature:    signatureHex(h.Signature),
+	})
+}
+
+func (h *BlockHeader) UnmarshalJSON(data []byte) error {
+	var previousHash string
+	var merkleRoot string
+	var signer, signature string
+	v := &struct {
+		Timestamp    *int64        `json:"timestamp"`
+		Nonce        *int          `json:"nonce"`
+		Difficulty   *int          `json:"difficulty"`
+		PreviousHash *string       `json:"previousHash"`
+		MerkleRoot   *string       `json:"merkleRoot"`
+		Config       **ChainConfig `json:"config"`
+		Signer       *string       `json:"signer"`
+		Signature    *string       `json:"signature"`
+	}{
+		Timestamp:    &h.Timestamp,
+		Nonce:        &h.Nonce,
+		Difficulty:   &h.Difficulty,
+		PreviousHash: &previousHash,
+		MerkleRoot:   &merkleRoot,
+		Config:       &h.Config,
+		Signer:       &signer,
+		Signature:    &signature,
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if err := decodeHash(previousHash, &h.PreviousHash); err != nil {
+		return err
+	}
+	if err := decodeSigner(signer, signature, &h.Signer, &h.Signature); err != nil {
+		return err
+	}
+	return decodeHash(merkleRoot, &h.MerkleRoot)
+}
+
+func publicKeyHex(publicKey *ecdsa.PublicKey) string {
+	if publicKey == nil {
+		return ""
+	}
+	return fmt.Sprintf("%064x%064x", publicKey.X.Bytes(), publicKey.Y.Bytes())
+}
+
+func signatureHex(s *utils.Signature) string {
+	if s == nil {
+		return ""
+	}
+	return s.String()
+}
+
+// decodeSigner ブロックの署名者の公開鍵と署名を読み込みます。空文字列はnilとして扱います。
+func decodeSigner(signer, signature string, publicKey **ecdsa.PublicKey, s **utils.Signature) error {
+	*publicKey = nil
+	*s = nil
+	if signer != "" {
+		if !isKeyPairHex(signer) {
+			return fmt.Errorf("invalid signer")
+		}
+		*publicKey = utils.PublicKeyFromString(signer)
+	}
+	if signature != "" {
+		if !isKeyPairHex(signature) {
+			return fmt.Errorf("invalid block signature")
+		}
+		*s = utils.SignatureFromString(signature)
+	}
+	return nil
+}
+
+// decodeHash 16進数文字列をハッシュに変換します。空文字列はゼロのハッシュとして扱います。
+func decodeHash(s string, hash *[32]byte) error {
+	if s == "" {
+		*hash = [32]byte{}
+		return nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != 32 {
+		return fmt.Errorf("invalid hash length %d", len(b))
+	}
+	copy(hash[:], b)
 	return nil
 }
@@ -4,8 +4,8 @@ import (
 	"blockchain_smp_go/utils"
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,24 +15,49 @@ import (
 )
 
 const (
-	MiningDifficulty = 3 // マイニング難易度
+	MiningDifficulty = 12 // マイニング難易度の初期値(ブロックハッシュの先頭ゼロビット数。16進数で3桁)
 	MiningSender     = "THE BLOCKCHAIN"
-	MiningReward     = 1.0 // マイニング報酬
-	MiningTimerSec   = 20  // マイニングタイマー(startmine実行時の間隔)
+	MiningReward     = 1 * Coin    // マイニング報酬の初期値
+	HalvingInterval  = 1000        // マイニング報酬が半分になる間隔(ブロック数)の初期値
+	MaxSupply        = 2000 * Coin // マイニング報酬で発行される量の上限の初期値
+	MiningTimerSec   = 20          // マイニングタイマー(startmine実行時の間隔)
+	MaxBlockSize     = 64 * 1024   // ブロックに入れるトランザクションのJSONの合計サイズの上限(バイト)
+
+	TargetBlockTimeSec    = 30  // 目標とするブロック間隔の初期値
+	RetargetInterval      = 10  // 難易度を調整する間隔(ブロック数)の初期値
+	MinDifficulty         = 1   // 難易度の下限
+	MaxDifficulty         = 256 // 難易度の上限
+	MaxDifficultyStep     = 2   // 1回の調整で変えられる難易度の幅
+	MaxFutureBlockTimeSec = 120 // 現在時刻よりどれだけ先のタイムスタンプを許すか
 
 	BlockchainPortRangeStart      = 5000
-	BlockchainPortRangeEnd        = 5004
+	BlockchainPortRangeEnd        = 5007 // BFTの7ノードまで同じホストで動かせるようにします
 	NeighborIpRangeStart          = 0
 	NeighborIpRangeEnd            = 1
 	BlockchainNeighborSyncTimeSec = 20
 )
 
+var ErrTransactionNotFound = errors.New("transaction not found")
+
 type Blockchain struct {
 	transactionPool   []*Transaction
-	chain             []*Block
+	pendingSpends     map[string]Amount
+	pendingReceipts   map[string]Amount
+	chain             BlockStore
+	tree              *BlockTree // サイドチェーンと孤立ブロックも含めた受け取ったブロック
+	orphanResolved    time.Time  // 孤立ブロックの親を探して最後にResolveConflictsした時刻
 	blockchainAddress string
 	port              uint16
+	config            *ChainConfig
+	state             *accountState // アカウント方式の残高とnonce
+	supply            Amount        // マイニング報酬で発行された量
+	reorgListeners    []func(*ReorgEvent)
+	utxos             *utxoSet // UTXO方式の未使用の出力
+	pendingInputs     map[OutPoint]string
+	engine            Consensus
+	signer            *ecdsa.PrivateKey // 署名でブロックを封印する合意の方式で使う鍵
 	mux               sync.Mutex
+	pow               powMiner
 
 	neighbors    []string
 	muxNeighbors sync.Mutex
@@ -40,17 +65,109 @@ type Blockchain struct {
 
 // NewBlockchain 新しいブロックチェーンを初期化します。最初のブロックを作成し、チェーンに追加します。
 func NewBlockchain(blockchainAddress string, port uint16) *Blockchain {
-	block := &Block{}
+	blockchain, _ := NewBlockchainWithStore(blockchainAddress, port, NewMemoryBlockStore(), nil)
+	return blockchain
+}
+
+// NewBlockchainWithStore storeに保存済みのチェーンがあればValidChainで検証してから使います。
+// 空の場合はconfig(nilならDefaultChainConfig)で最初のブロックを作成します。保存済みのチェーンではジェネシスブロックの設定が優先されます。
+func NewBlockchainWithStore(blockchainAddress string, port uint16, store BlockStore, config *ChainConfig) (*Blockchain, error) {
+	if config == nil {
+		config = DefaultChainConfig()
+	}
+	if !config.ValidLedger() {
+		return nil, fmt.Errorf("unknown ledger %q", config.Ledger)
+	}
 	blockchain := &Blockchain{
+		chain:             store,
 		blockchainAddress: blockchainAddress,
 		port:              port,
+		config:            config,
+		state:             newAccountState(),
+		utxos:             newUTXOSet(),
+		pendingInputs:     make(map[OutPoint]string),
+		pendingSpends:     make(map[string]Amount),
+		pendingReceipts:   make(map[string]Amount),
 	}
-	blockchain.CreateBlock(0, block.Hash())
-	return blockchain
+	if store.Height() == 0 {
+		engine, err := NewConsensus(config)
+		if err != nil {
+			return nil, err
+		}
+		blockchain.engine = engine
+		if err := blockchain.createGenesisBlock(); err != nil {
+			return nil, err
+		}
+		blockchain.tree = newBlockTree(engine.Weight)
+		blockchain.tree.addChain(blockchain.Chain())
+		return blockchain, nil
+	}
+	genesis, err := store.BlockByHeight(0)
+	if err != nil {
+		return nil, err
+	}
+	if genesis.Config == nil {
+		return nil, fmt.Errorf("genesis block has no chain config")
+	}
+	if !genesis.Config.Equal(config) {
+		log.Printf("WARNING: using the chain config stored in the genesis block")
+	}
+	blockchain.config = genesis.Config
+	engine, err := NewConsensus(blockchain.config)
+	if err != nil {
+		return nil, err
+	}
+	blockchain.engine = engine
+	chain := blockchain.Chain()
+	if !blockchain.ValidChain(chain) {
+		return nil, fmt.Errorf("invalid chain in block store")
+	}
+	for _, b := range chain {
+		blockchain.applyBlock(b)
+	}
+	blockchain.tree = newBlockTree(engine.Weight)
+	blockchain.tree.addChain(chain)
+	log.Printf("blockchain: action=load, blocks=%d", store.Height())
+	return blockchain, nil
+}
+
+// LoadBlockchain dataDirのFileBlockStoreからチェーンを読み込みます。
+func LoadBlockchain(blockchainAddress string, port uint16, dataDir string, config *ChainConfig) (*Blockchain, error) {
+	store, err := OpenFileBlockStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	blockchain, err := NewBlockchainWithStore(blockchainAddress, port, store, config)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("%s: %v", dataDir, err)
+	}
+	return blockchain, nil
+}
+
+// createGenesisBlock チェーン設定を持つ最初のブロックを作成します。
+func (bc *Blockchain) createGenesisBlock() error {
+	block := &Block{}
+	header := &BlockHeader{Timestamp: time.Now().UnixNano()}
+	if err := bc.engine.Prepare(bc.storedBlockAt, 0, header); err != nil {
+		return err
+	}
+	genesis := NewBlock(0, block.Hash(), header.Difficulty, nil)
+	genesis.Timestamp = header.Timestamp
+	genesis.Config = bc.config
+	if err := bc.chain.PutBlock(genesis); err != nil {
+		return err
+	}
+	bc.applyBlock(genesis)
+	return nil
 }
 
 func (bc *Blockchain) Chain() []*Block {
-	return bc.chain
+	return storedChain(bc.chain)
+}
+
+func (bc *Blockchain) Config() *ChainConfig {
+	return bc.config
 }
 
 // Run 隣接ノードの同期とチェーンのコンフリクト解決を開始します。
@@ -78,47 +195,39 @@ func (bc *Blockchain) StartSyncNeighbors() {
 	time.AfterFunc(time.Second*BlockchainNeighborSyncTimeSec, bc.StartSyncNeighbors)
 }
 
-func (bc *Blockchain) CreateBlock(nonce int, previousHash [32]byte) *Block {
-	cblock := NewBlock(nonce, previousHash, bc.transactionPool)
-	bc.chain = append(bc.chain, cblock)
-	bc.transactionPool = []*Transaction{}
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/transactions", n)
-		client := &http.Client{}
-		req, err := http.NewRequest("DELETE", endpoint, nil)
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
-		}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
-		}
-		log.Printf("Deleted transactions at %v: %v", n, resp.Status)
+// addBlock ブロックをチェーンに追加し、そのブロックに含まれるトランザクションだけをプールから取り除きます。
+func (bc *Blockchain) addBlock(cblock *Block) *Block {
+	if err := bc.chain.PutBlock(cblock); err != nil {
+		log.Printf("ERROR: %v", err)
+		return nil
 	}
+	bc.applyBlock(cblock)
+	bc.tree.add(cblock)
+	bc.tipChanged()
+	bc.removeFromPool(cblock.Transactions)
 	return cblock
 }
 
 func (bc *Blockchain) LastBlock() *Block {
-	return bc.chain[len(bc.chain)-1]
+	b, err := bc.chain.Tip()
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	return b
 }
 
-func (bc *Blockchain) CreateTransaction(sender string, recipient string, value float32,
+func (bc *Blockchain) CreateTransaction(sender string, recipient string, value Amount, fee Amount, nonce uint64,
 	senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	isTransacted := bc.AddTransaction(sender, recipient, value, senderPublicKey, s)
+	return bc.CreateSignedTransaction(NewSignedTransaction(sender, recipient, value, fee, nonce, senderPublicKey, s))
+}
+
+// CreateSignedTransaction トランザクションをプールに追加し、成功したら隣接ノードにも送ります。
+func (bc *Blockchain) CreateSignedTransaction(transaction *Transaction) bool {
+	isTransacted := bc.AddSignedTransaction(transaction)
 
 	if isTransacted {
 		for _, n := range bc.neighbors {
-			publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(), senderPublicKey.Y.Bytes())
-			signatureStr := s.String()
-			bt := &TransactionRequest{
-				SenderBlockchainAddress:    &sender,
-				RecipientBlockchainAddress: &recipient,
-				SenderPublicKey:            &publicKeyStr,
-				Value:                      &value,
-				Signature:                  &signatureStr,
-			}
+			bt := NewTransactionRequest(transaction)
 			m, _ := json.Marshal(bt)
 			buf := bytes.NewBuffer(m)
 			endpoint := fmt.Sprintf("http://%s/transactions", n)
@@ -140,25 +249,88 @@ func (bc *Blockchain) CreateTransaction(sender string, recipient string, value f
 	return isTransacted
 }
 
-func (bc *Blockchain) AddTransaction(sender string, recipient string, value float32,
+func (bc *Blockchain) AddTransaction(sender string, recipient string, value Amount, fee Amount, nonce uint64,
 	senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	transaction := NewTransaction(sender, recipient, value)
+	return bc.AddSignedTransaction(NewSignedTransaction(sender, recipient, value, fee, nonce, senderPublicKey, s))
+}
+
+// AddSignedTransaction 署名済みのトランザクションを検証してプールに追加します。
+// UTXO方式のチェーンではnonceと残高の代わりに入力と出力を検証します。
+func (bc *Blockchain) AddSignedTransaction(transaction *Transaction) bool {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	sender := transaction.SenderBlockchainAddress
+
+	if transaction.Value <= 0 || transaction.Value > MaxAmount {
+		log.Printf("ERROR: Value must be positive and at most %s", MaxAmount)
+		return false
+	}
+
+	if !ValidAmount(transaction.Fee) {
+		log.Printf("ERROR: Fee must be between 0 and %s", MaxAmount)
+		return false
+	}
 
 	if sender == MiningSender {
-		log.Println("INFO: Mining reward")
-		bc.transactionPool = append(bc.transactionPool, transaction)
-		return true
+		log.Println("ERROR: Mining rewards are added only by Mining")
+		return false
 	}
 
-	if bc.VerifyTransactionSignature(senderPublicKey, s, transaction) {
+	if transaction.IsSlashing() || transaction.Evidence != nil {
+		log.Println("ERROR: Slashing transactions are added only with double-sign evidence")
+		return false
+	}
+
+	if !utils.IsAddressOwner(transaction.SenderPublicKey, sender) {
+		log.Println("ERROR: Public key does not own the sender address")
+		return false
+	}
+
+	utxo := bc.config.UTXO()
+	if !utxo && (len(transaction.Inputs) > 0 || len(transaction.Outputs) > 0) {
+		log.Println("ERROR: Inputs and outputs are only used by a UTXO ledger")
+		return false
+	}
+
+	if utxo && (transaction.IsStake() || transaction.IsUnstake()) {
+		log.Println("ERROR: Staking is only supported by an account ledger")
+		return false
+	}
+
+	if expected := bc.nextNonce(sender); !utxo && transaction.Nonce != expected {
+		log.Printf("ERROR: Nonce %d, expected %d", transaction.Nonce, expected)
+		return false
+	}
 
-		if bc.CalculateTotalAmount(sender) < value {
+	if transaction.VerifySignature() {
+
+		if utxo {
+			if _, err := bc.utxos.checkTransaction(transaction); err != nil {
+				log.Printf("ERROR: %v", err)
+				return false
+			}
+			for _, op := range transaction.Inputs {
+				if id, ok := bc.pendingInputs[op]; ok {
+					log.Printf("ERROR: Input %s is already spent by %s", op, id)
+					return false
+				}
+			}
+		} else if transaction.IsUnstake() {
+			if bc.Stake(sender)-bc.pendingUnstake(sender) < transaction.Value {
+				log.Println("ERROR: Not enough stake to unstake")
+				return false
+			}
+			if !bc.canSpend(sender, transaction.Fee) {
+				log.Println("ERROR: Not enough balance in a wallet")
+				return false
+			}
+		} else if !bc.canSpend(sender, transaction.Value, transaction.Fee) {
 			log.Println("ERROR: Not enough balance in a wallet")
 			return false
 		}
 
 		log.Println("INFO: Transaction signature is valid")
-		bc.transactionPool = append(bc.transactionPool, transaction)
+		bc.addToPool(transaction)
 		return true
 	} else {
 		log.Println("ERROR: Verify Transaction")
@@ -166,156 +338,210 @@ func (bc *Blockchain) AddTransaction(sender string, recipient string, value floa
 	return false
 }
 
-func (bc *Blockchain) VerifyTransactionSignature(
-	senderPublicKey *ecdsa.PublicKey, s *utils.Signature, t *Transaction) bool {
-	m, _ := json.Marshal(t)
-	h := sha256.Sum256([]byte(m))
-	return ecdsa.Verify(senderPublicKey, h[:], s.R, s.S)
-}
-
-func (bc *Blockchain) CopyTransactionPool() []*Transaction {
-	transactions := make([]*Transaction, 0, len(bc.transactionPool))
-	for _, t := range bc.transactionPool {
-		transactions = append(transactions,
-			NewTransaction(t.SenderBlockchainAddress, t.RecipientBlockchainAddress, t.Value))
+// newMiningReward 報酬と手数料の合計をマイナーに支払うトランザクションを作成します。
+func (bc *Blockchain) newMiningReward(fees Amount) *Transaction {
+	log.Println("INFO: Mining reward")
+	value, err := SumAmounts(bc.config.BlockReward(bc.chain.Height()), fees)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		value = bc.config.BlockReward(bc.chain.Height())
 	}
-	return transactions
+	reward := NewTransaction(MiningSender, bc.rewardAddress(), value)
+	reward.Nonce = uint64(bc.chain.Height())
+	return reward
 }
 
-func (bc *Blockchain) TransactionPool() []*Transaction {
-	return bc.transactionPool
+// ConfirmedNonce チェーンに含まれるaddressからの送金の数、つまり次に使うべきnonceを返します。
+func (bc *Blockchain) ConfirmedNonce(address string) uint64 {
+	return bc.state.Nonce(address)
 }
 
-func (bc *Blockchain) ClearTransactionPool() {
-	bc.transactionPool = bc.transactionPool[:0]
-}
-
-func (bc *Blockchain) ValidProof(nonce int, previousHash [32]byte, transactions []*Transaction, difficulty int) bool {
-	zeros := strings.Repeat("0", difficulty)
-	guessBlock := Block{Nonce: nonce, PreviousHash: previousHash, Transactions: transactions}
-	guessHashStr := fmt.Sprintf("%x", guessBlock.Hash())
-	return guessHashStr[:difficulty] == zeros
+// NextNonce トランザクションプールの未承認の送金も含めて、addressが次に使うべきnonceを返します。
+func (bc *Blockchain) NextNonce(address string) uint64 {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.nextNonce(address)
 }
 
-func (bc *Blockchain) ProofOfWork() int {
-	transactions := bc.CopyTransactionPool()
-	previousHash := bc.LastBlock().Hash()
-	nonce := 0
-	for !bc.ValidProof(nonce, previousHash, transactions, MiningDifficulty) {
-		nonce++
+func (bc *Blockchain) nextNonce(address string) uint64 {
+	nonce := bc.ConfirmedNonce(address)
+	for _, t := range bc.transactionPool {
+		if t.SenderBlockchainAddress == address && !t.IsSlashing() {
+			nonce++
+		}
 	}
 	return nonce
 }
 
-func (bc *Blockchain) Mining() bool {
+// TransactionPool プールのトランザクションの一覧のコピーを返します。
+func (bc *Blockchain) TransactionPool() []*Transaction {
 	bc.mux.Lock()
 	defer bc.mux.Unlock()
+	return append([]*Transaction(nil), bc.transactionPool...)
+}
 
-	bc.AddTransaction(MiningSender, bc.blockchainAddress, MiningReward, nil, nil)
-	nonce := bc.ProofOfWork()
-	previousHash := bc.LastBlock().Hash()
-	bc.CreateBlock(nonce, previousHash)
-	log.Println("blockchain: action=mining, status=success")
+// Mining ブロックのテンプレートを作成して合意の方式で封印し、そのテンプレートのままチェーンに追加します。
+// 封印(プルーフオブワーク)の間はbc.muxを解放するので、その間に他のノードのチェーンを採用でき、
+// プールへのトランザクションの追加も待たされません(プールを扱う公開メソッドは全てbc.muxを取ります)。
+// チェーンが置き換わった場合は封印を中断してfalseを返します。
+func (bc *Blockchain) Mining() bool {
+	tmpl, err := bc.NewBlockTemplate()
+	if err != nil {
+		log.Printf("blockchain: action=mining, status=fail, reason=%v", err)
+		return false
+	}
 
+	b, err := bc.engine.Seal(bc, tmpl)
+	if err != nil {
+		log.Printf("blockchain: action=mining, status=aborted, reason=%v", err)
+		return false
+	}
+
+	if _, err := bc.CommitBlock(tmpl, b); err != nil {
+		log.Printf("blockchain: action=mining, status=aborted, reason=%v", err)
+		return false
+	}
+	log.Printf("blockchain: action=mining, status=success, consensus=%s, height=%d, difficulty=%d, transactions=%d",
+		bc.engine.Name(), tmpl.Height, tmpl.Header.Difficulty, len(tmpl.Transactions))
+
+	bc.broadcastBlock(b)
+	return true
+}
+
+// broadcastBlock 作ったブロックを隣接ノードのPOST /blocksに送ります。親を持たないノードは孤立ブロックとして受け取り、チェーンを取りに来ます。
+func (bc *Blockchain) broadcastBlock(b *Block) {
+	m, err := json.Marshal(b)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return
+	}
 	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/consensus", n)
-		client := &http.Client{}
-		req, err := http.NewRequest("PUT", endpoint, nil)
+		endpoint := fmt.Sprintf("http://%s/blocks", n)
+		resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(m))
 		if err != nil {
 			log.Printf("ERROR: %v", err)
 			continue
 		}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
-		}
-		log.Printf("Consensus at %v: %v", n, resp.Status)
+		resp.Body.Close()
+		log.Printf("Block at %v: %v", n, resp.Status)
 	}
-
-	return true
 }
 
+// StartMining 定期的にブロックを作ります。合意の方式がRunnerの場合はそれに任せ、BlockSchedulerの場合はその番と時刻に従います。
 func (bc *Blockchain) StartMining() {
+	if runner, ok := bc.engine.(Runner); ok {
+		runner.Run(bc)
+		return
+	}
+	if scheduler, ok := bc.engine.(BlockScheduler); ok {
+		bc.produceScheduled(scheduler)
+		return
+	}
 	bc.Mining()
 	time.AfterFunc(MiningTimerSec*time.Second, bc.StartMining)
 }
 
-func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) float32 {
-	var totalAmount float32 = 0.0
-	for _, b := range bc.chain {
-		for _, t := range b.Transactions {
-			value := t.Value
-			if blockchainAddress == t.RecipientBlockchainAddress {
-				totalAmount += value
-			}
-			if blockchainAddress == t.SenderBlockchainAddress {
-				totalAmount -= value
-			}
-		}
+// CalculateTotalAmount 残高のインデックス(UTXO方式では未使用の出力の合計)から承認済みの残高を返します。
+func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) Amount {
+	if bc.config.UTXO() {
+		return bc.utxos.Balance(blockchainAddress)
 	}
-	return totalAmount
+	return bc.state.Balance(blockchainAddress)
 }
 
-func (bc *Blockchain) ValidChain(chain []*Block) bool {
-	preBlock := chain[0]
-	currentIndex := 1
-	for currentIndex < len(chain) {
-		block := chain[currentIndex]
-		if block.PreviousHash != preBlock.Hash() {
-			return false
-		}
-
-		if !bc.ValidProof(block.Nonce, preBlock.Hash(), block.Transactions, MiningDifficulty) {
-			return false
-		}
+// peerChain 隣接ノードから取得した、まだ検証していないチェーンです。
+type peerChain struct {
+	peer  string
+	chain []*Block
+}
 
-		preBlock = block
-		currentIndex++
+// fetchChain 隣接ノードのチェーンをブロックの列として取得します。状態には何も適用しません。
+func fetchChain(peer string) ([]*Block, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/chain", peer))
+	if err != nil {
+		return nil, err
 	}
-	return true
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /chain at %s: %s", peer, resp.Status)
+	}
+	var v struct {
+		Blocks []*Block `json:"chain"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v.Blocks, nil
 }
 
-func (bc *Blockchain) ResolveConflicts() bool {
-	var longestChain []*Block = nil
-	maxLength := len(bc.chain)
-
+// ResolveConflicts 隣接ノードのチェーンを取得し、検証済みのチェーンの中で累積計算量が最も多いものを採用します。
+// 問い合わせの間はbc.muxを持たず、取得したチェーンの検証と採用はロックを持ったまま自ノードのチェーンと比べます。
+func (bc *Blockchain) ResolveConflicts() *ConsensusResult {
+	var fetched []peerChain
 	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/chain", n)
-		resp, err := http.Get(endpoint)
+		chain, err := fetchChain(n)
 		if err != nil {
 			log.Printf("ERROR: %v", err)
 			continue
 		}
-		if resp.StatusCode == 200 {
-			var bcResp Blockchain
-			decoder := json.NewDecoder(resp.Body)
-			err = decoder.Decode(&bcResp)
-			if err != nil {
-				log.Printf("ERROR: %v", err)
-				continue
-			}
+		if len(chain) == 0 {
+			continue
+		}
+		fetched = append(fetched, peerChain{peer: n, chain: chain})
+	}
 
-			chain := bcResp.Chain()
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	local := bc.newConsensusCandidate(LocalPeer, bc.Chain())
+	local.Valid = true
+	result := &ConsensusResult{Winner: LocalPeer, Local: local}
+
+	best := local
+	var bestChain []*Block = nil
+	for _, pc := range fetched {
+		candidate := bc.newConsensusCandidate(pc.peer, pc.chain)
+		candidate.Valid = bc.ValidChain(pc.chain)
+		if fork, finalized := bc.forkHeight(pc.chain), bc.finalizedHeight(); candidate.Valid && fork <= finalized {
+			log.Printf("blockchain: action=resolve, peer=%s, status=rejected, fork=%d, finalized=%d", pc.peer, fork, finalized)
+			candidate.Valid = false
+		}
+		result.Candidates = append(result.Candidates, candidate)
+		if candidate.Valid {
+			// 採用しないチェーンも、後で切り替えられるようブロックの木に残します
+			bc.tree.addChain(pc.chain)
+		}
 
-			if len(chain) > maxLength && bc.ValidChain(chain) {
-				maxLength = len(chain)
-				longestChain = chain
-			}
+		if candidate.Valid && candidate.heavierThan(best) {
+			best = candidate
+			bestChain = pc.chain
 		}
 	}
 
-	if longestChain != nil {
-		bc.chain = longestChain
-		log.Printf("blockchain: action=resolve, status=success")
-		return true
+	if bestChain != nil {
+		event, err := bc.reorganize(bestChain)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+		} else {
+			result.Replaced = true
+			result.Reorg = event
+			result.Winner = best.Peer
+			log.Printf("blockchain: action=resolve, status=success, peer=%s, work=%s, local_work=%s",
+				best.Peer, best.Work, local.Work)
+		}
 	}
-	log.Printf("blockchain: action=resolve, status=fail")
-	return false
+	if !result.Replaced {
+		log.Printf("blockchain: action=resolve, status=fail, local_work=%s", local.Work)
+	}
+	// 取得したチェーンで親が揃った孤立ブロックをつなぎ、それで重くなったチェーンがあれば切り替えます
+	bc.connectOrphans()
+	if err := bc.activateBestTip(); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	return result
 }
 
 func (bc *Blockchain) Print() {
-	for i, block := range bc.chain {
+	for i, block := range bc.Chain() {
 		fmt.Printf("%s Chain %d %s\n", strings.Repeat("=", 25), i, strings.Repeat("=", 25))
 		block.Print()
 	}
@@ -326,18 +552,6 @@ func (bc *Blockchain) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Blocks []*Block `json:"chain"`
 	}{
-		Blocks: bc.chain,
+		Blocks: bc.Chain(),
 	})
 }
-
-func (bc *Blockchain) UnmarshalJSON(data []byte) error {
-	v := &struct {
-		Blocks *[]*Block `json:"chain"`
-	}{
-		Blocks: &bc.chain,
-	}
-	if err := json.Unmarshal(data, &v); err != nil {
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,55 @@
+package block
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// servePeerChain GET /chainでchainを返す隣接ノードを起動し、そのアドレスを返します。
+func servePeerChain(t *testing.T, chain []*Block) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(struct {
+			Blocks []*Block `json:"chain"`
+		}{
+			Blocks: chain,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// TestResolveConflicts 隣接ノードのチェーンを検証してから、有効で重いチェーンだけを採用することを確認します。
+func TestResolveConflicts(t *testing.T) {
+	_, alice := newTestKey(t)
+	a := newTestBlockchain(t, alice)
+	b := forkBlockchain(t, a, "bob", 1)
+	mineBlocks(t, b, 2)
+
+	good := b.Chain()
+	last := *good[len(good)-1]
+	last.Transactions = append(append([]*Transaction(nil), last.Transactions...), NewTransaction(MiningSender, "mallory", Coin))
+	bad := append(append([]*Block(nil), good[:len(good)-1]...), &last)
+
+	badPeer, goodPeer := servePeerChain(t, bad), servePeerChain(t, good)
+	a.neighbors = []string{badPeer, goodPeer}
+	result := a.ResolveConflicts()
+	if !result.Replaced || result.Winner != goodPeer {
+		t.Fatalf("replaced = %t, winner = %s, want %s", result.Replaced, result.Winner, goodPeer)
+	}
+	if len(result.Candidates) != 2 || result.Candidates[0].Valid || !result.Candidates[1].Valid {
+		t.Errorf("candidates = %+v", result.Candidates)
+	}
+	if a.LastBlock().Hash() != b.LastBlock().Hash() {
+		t.Error("did not adopt the peer's chain")
+	}
+	if got := a.CalculateTotalAmount("mallory"); got != 0 {
+		t.Errorf("balance of mallory = %s, want 0", got)
+	}
+	if err := a.CheckBalanceIndex(); err != nil {
+		t.Fatal(err)
+	}
+}
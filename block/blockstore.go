@@ -0,0 +1,120 @@
+package block
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockStore ブロックの保存先を抽象化します。Blockchainはチェーンをこのインターフェース経由でのみ扱います。
+type BlockStore interface {
+	// PutBlock ブロックをチェーンの末尾に追加します。
+	PutBlock(b *Block) error
+	// ReplaceFrom height以降のブロックを破棄し、blocksで置き換えます。
+	ReplaceFrom(height int, blocks []*Block) error
+	BlockByHash(hash [32]byte) (*Block, error)
+	BlockByHeight(height int) (*Block, error)
+	// Tip 末尾のブロックを返します。チェーンが空の場合はErrBlockNotFoundを返します。
+	Tip() (*Block, error)
+	// Height 保存されているブロックの数を返します。
+	Height() int
+	// Iterate 高さの順にブロックを渡します。fnがfalseを返すと中断します。
+	Iterate(fn func(height int, b *Block) bool) error
+	Close() error
+}
+
+// MemoryBlockStore メモリ上のスライスにブロックを保持するBlockStoreです。
+type MemoryBlockStore struct {
+	blocks  []*Block
+	heights map[[32]byte]int
+	mux     sync.RWMutex
+}
+
+func NewMemoryBlockStore() *MemoryBlockStore {
+	return &MemoryBlockStore{heights: make(map[[32]byte]int)}
+}
+
+func (ms *MemoryBlockStore) PutBlock(b *Block) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.heights[b.Hash()] = len(ms.blocks)
+	ms.blocks = append(ms.blocks, b)
+	return nil
+}
+
+func (ms *MemoryBlockStore) ReplaceFrom(height int, blocks []*Block) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	if height < 0 || height > len(ms.blocks) {
+		return ErrBlockNotFound
+	}
+	for _, b := range ms.blocks[height:] {
+		delete(ms.heights, b.Hash())
+	}
+	ms.blocks = append(ms.blocks[:height:height], blocks...)
+	for i, b := range blocks {
+		ms.heights[b.Hash()] = height + i
+	}
+	return nil
+}
+
+func (ms *MemoryBlockStore) BlockByHash(hash [32]byte) (*Block, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	h, ok := ms.heights[hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return ms.blocks[h], nil
+}
+
+func (ms *MemoryBlockStore) BlockByHeight(height int) (*Block, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	if height < 0 || height >= len(ms.blocks) {
+		return nil, ErrBlockNotFound
+	}
+	return ms.blocks[height], nil
+}
+
+func (ms *MemoryBlockStore) Tip() (*Block, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	if len(ms.blocks) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	return ms.blocks[len(ms.blocks)-1], nil
+}
+
+func (ms *MemoryBlockStore) Height() int {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	return len(ms.blocks)
+}
+
+func (ms *MemoryBlockStore) Iterate(fn func(height int, b *Block) bool) error {
+	ms.mux.RLock()
+	blocks := ms.blocks
+	ms.mux.RUnlock()
+	for i, b := range blocks {
+		if !fn(i, b) {
+			break
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryBlockStore) Close() error {
+	return nil
+}
+
+// storedChain BlockStoreの中身をスライスとして取り出します。
+func storedChain(s BlockStore) []*Block {
+	chain := make([]*Block, 0, s.Height())
+	s.Iterate(func(_ int, b *Block) bool {
+		chain = append(chain, b)
+		return true
+	})
+	return chain
+}
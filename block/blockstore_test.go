@@ -0,0 +1,141 @@
+package block
+
+import "testing"
+
+// testBlocks n個の連なったブロックを作ります。nonceを変えるとハッシュの異なるチェーンになります。
+func testBlocks(n int, previous [32]byte, nonce int) []*Block {
+	blocks := make([]*Block, n)
+	for i := range blocks {
+		blocks[i] = NewBlock(nonce+i, previous, MinDifficulty, []*Transaction{NewTransaction(MiningSender, "miner", Coin)})
+		previous = blocks[i].Hash()
+	}
+	return blocks
+}
+
+// checkStoredChain storeにwantの順でブロックが保存されていることを確認します。
+func checkStoredChain(t *testing.T, name string, store BlockStore, want []*Block) {
+	t.Helper()
+	if store.Height() != len(want) {
+		t.Fatalf("%s: height = %d, want %d", name, store.Height(), len(want))
+	}
+	for h, b := range want {
+		got, err := store.BlockByHeight(h)
+		if err != nil || got.Hash() != b.Hash() {
+			t.Errorf("%s: block %d = %v, %v", name, h, got, err)
+		}
+		if got, err := store.BlockByHash(b.Hash()); err != nil || got.Hash() != b.Hash() {
+			t.Errorf("%s: block %x by hash: %v", name, b.Hash(), err)
+		}
+	}
+	tip, err := store.Tip()
+	if len(want) == 0 {
+		if err != ErrBlockNotFound {
+			t.Errorf("%s: tip of an empty store: %v", name, err)
+		}
+		return
+	}
+	if err != nil || tip.Hash() != want[len(want)-1].Hash() {
+		t.Errorf("%s: tip = %v, %v", name, tip, err)
+	}
+}
+
+// TestBlockStore どちらのBlockStoreも追加、置き換え、順番の走査を同じように扱うことを確認します。
+func TestBlockStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) BlockStore{
+		"memory": func(t *testing.T) BlockStore {
+			return NewMemoryBlockStore()
+		},
+		"file": func(t *testing.T) BlockStore {
+			fs, err := OpenFileBlockStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fs
+		},
+	}
+	for name, open := range stores {
+		store := open(t)
+		checkStoredChain(t, name, store, nil)
+
+		chain := testBlocks(4, [32]byte{}, 0)
+		for _, b := range chain {
+			if err := store.PutBlock(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkStoredChain(t, name, store, chain)
+
+		// 高さ2から別の3ブロックに置き換えると、置き換えられたブロックはハッシュでも見つかりません
+		branch := testBlocks(3, chain[1].Hash(), 100)
+		if err := store.ReplaceFrom(2, branch); err != nil {
+			t.Fatal(err)
+		}
+		replaced := append(chain[:2:2], branch...)
+		checkStoredChain(t, name, store, replaced)
+		for _, b := range chain[2:] {
+			if _, err := store.BlockByHash(b.Hash()); err != ErrBlockNotFound {
+				t.Errorf("%s: replaced block %x is still stored: %v", name, b.Hash(), err)
+			}
+		}
+		if err := store.ReplaceFrom(store.Height()+1, nil); err != ErrBlockNotFound {
+			t.Errorf("%s: replaced beyond the tip: %v", name, err)
+		}
+
+		var heights []int
+		if err := store.Iterate(func(height int, b *Block) bool {
+			if b.Hash() != replaced[height].Hash() {
+				t.Errorf("%s: iterated block %d out of order", name, height)
+			}
+			heights = append(heights, height)
+			return height < 2
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(heights) != 3 {
+			t.Errorf("%s: iterated heights %v, want to stop after 2", name, heights)
+		}
+
+		if err := store.ReplaceFrom(0, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkStoredChain(t, name, store, nil)
+		store.Close()
+	}
+}
+
+// TestFileBlockStoreReopen 置き換えたチェーンがファイルから読み直しても同じになることを確認します。
+func TestFileBlockStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testBlocks(5, [32]byte{}, 0)
+	if err := fs.ReplaceFrom(0, chain); err != nil {
+		t.Fatal(err)
+	}
+	branch := testBlocks(2, chain[2].Hash(), 100)
+	if err := fs.ReplaceFrom(3, branch); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = OpenFileBlockStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	want := append(chain[:3:3], branch...)
+	checkStoredChain(t, "reopened", fs, want)
+	if _, err := fs.BlockByHash(chain[4].Hash()); err != ErrBlockNotFound {
+		t.Errorf("replaced block is stored after reopening: %v", err)
+	}
+	reloaded := storedChain(fs)
+	for h, b := range reloaded {
+		if len(b.Transactions) != 1 || b.Transactions[0].ID() != want[h].Transactions[0].ID() {
+			t.Errorf("block %d lost its transactions after reopening", h)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxOrphanBlocks 親が届くまで保持する孤立ブロックの数の上限です。超えると古いものから捨てます。
+const MaxOrphanBlocks = 100
+
+// OrphanResolveIntervalSec 孤立ブロックの親を探すために隣接ノードのチェーンを取りに行く最短の間隔です。
+const OrphanResolveIntervalSec = 10
+
+// ChainTip.Statusの値です。
+const (
+	TipActive = "active"     // 自ノードのチェーンの末尾
+	TipFork   = "valid-fork" // 検証済みで、自ノードのチェーンから分岐したチェーンの末尾
+)
+
+var ErrOrphanBlock = errors.New("parent block is unknown")
+
+// treeNode ブロックの木の1つのブロックです。Workはジェネシスブロックからこのブロックまでの累積の重みです。
+type treeNode struct {
+	block    *Block
+	hash     [32]byte
+	height   int
+	work     *big.Int
+	parent   *treeNode
+	children int
+}
+
+// BlockTree 検証済みのブロックを、自ノードのチェーン以外の分岐(サイドチェーン)も含めて保持します。
+// 親がまだ届いていないブロックは孤立ブロックとして別に保持し、親が届いた時につなぎます。
+// サイドチェーンと孤立ブロックはメモリ上だけにあり、BlockStoreには自ノードのチェーンだけを保存します。
+type BlockTree struct {
+	nodes   map[[32]byte]*treeNode
+	root    *treeNode
+	orphans map[[32]byte]*Block
+	order   [][32]byte // 孤立ブロックを受け取った順
+	weight  func(header *BlockHeader) *big.Int
+	mux     sync.RWMutex
+}
+
+func newBlockTree(weight func(header *BlockHeader) *big.Int) *BlockTree {
+	return &BlockTree{
+		nodes:   make(map[[32]byte]*treeNode),
+		orphans: make(map[[32]byte]*Block),
+		weight:  weight,
+	}
+}
+
+// has ブロックが木か孤立ブロックにあるか返します。
+func (bt *BlockTree) has(hash [32]byte) bool {
+	bt.mux.RLock()
+	defer bt.mux.RUnlock()
+	_, ok := bt.nodes[hash]
+	_, orphan := bt.orphans[hash]
+	return ok || orphan
+}
+
+// connected ブロックが木につながっているか返します。
+func (bt *BlockTree) connected(hash [32]byte) bool {
+	bt.mux.RLock()
+	defer bt.mux.RUnlock()
+	_, ok := bt.nodes[hash]
+	return ok
+}
+
+// add 親が木にあるブロックを追加します。最初のブロックは親なしで根になります。追加できなかった場合はfalseを返します。
+func (bt *BlockTree) add(b *Block) bool {
+	bt.mux.Lock()
+	defer bt.mux.Unlock()
+	return bt.addLocked(b)
+}
+
+func (bt *BlockTree) addLocked(b *Block) bool {
+	hash := b.Hash()
+	if _, ok := bt.nodes[hash]; ok {
+		return true
+	}
+	node := &treeNode{block: b, hash: hash, work: new(big.Int).Set(bt.weight(b.Header()))}
+	if bt.root == nil {
+		bt.root = node
+	} else {
+		parent, ok := bt.nodes[b.PreviousHash]
+		if !ok {
+			return false
+		}
+		node.parent = parent
+		node.height = parent.height + 1
+		node.work.Add(node.work, parent.work)
+		parent.children++
+	}
+	bt.nodes[hash] = node
+	bt.removeOrphan(hash)
+	return true
+}
+
+// addChain 検証済みのチェーンのブロックをまとめて追加します。
+func (bt *BlockTree) addChain(chain []*Block) {
+	bt.mux.Lock()
+	defer bt.mux.Unlock()
+	for _, b := range chain {
+		if !bt.addLocked(b) {
+			return
+		}
+	}
+}
+
+// reset 木をchainのブロックだけにします。ジェネシスブロックの異なるチェーンに置き換えたときに使い、孤立ブロックは残します。
+func (bt *BlockTree) reset(chain []*Block) {
+	bt.mux.Lock()
+	defer bt.mux.Unlock()
+	bt.nodes = make(map[[32]byte]*treeNode)
+	bt.root = nil
+	for _, b := range chain {
+		if !bt.addLocked(b) {
+			return
+		}
+	}
+}
+
+// addOrphan 親が木にないブロックを保持します。上限を超えた場合は最も古い孤立ブロックを捨てます。
+func (bt *BlockTree) addOrphan(b *Block) {
+	bt.mux.Lock()
+	defer bt.mux.Unlock()
+	hash := b.Hash()
+	if _, ok := bt.orphans[hash]; ok {
+		return
+	}
+	bt.orphans[hash] = b
+	bt.order = append(bt.order, hash)
+	for len(bt.order) > MaxOrphanBlocks {
+		delete(bt.orphans, bt.order[0])
+		bt.order = bt.order[1:]
+	}
+}
+
+func (bt *BlockTree) removeOrphan(hash [32]byte) {
+	if _, ok := bt.orphans[hash]; !ok {
+		return
+	}
+	delete(bt.orphans, hash)
+	for i, h := range bt.order {
+		if h == hash {
+			bt.order = append(bt.order[:i], bt.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// takeOrphans 親が木につながった孤立ブロックを受け取った順に取り出します。
+func (bt *BlockTree) takeOrphans() []*Block {
+	bt.mux.Lock()
+	defer bt.mux.Unlock()
+	var ready []*Block
+	for _, hash := range bt.order {
+		b := bt.orphans[hash]
+		if _, ok := bt.nodes[b.PreviousHash]; ok {
+			ready = append(ready, b)
+		}
+	}
+	for _, b := range ready {
+		bt.removeOrphan(b.Hash())
+	}
+	return ready
+}
+
+// branch ジェネシスブロックからhashのブロックまでのチェーンを返します。
+func (bt *BlockTree) branch(hash [32]byte) []*Block {
+	bt.mux.RLock()
+	defer bt.mux.RUnlock()
+	node, ok := bt.nodes[hash]
+	if !ok {
+		return nil
+	}
+	chain := make([]*Block, node.height+1)
+	for ; node != nil; node = node.parent {
+		chain[node.height] = node.block
+	}
+	return chain
+}
+
+// tips 子を持たないブロック(各チェーンの末尾)を、重い順に返します。
+func (bt *BlockTree) tips() []*treeNode {
+	bt.mux.RLock()
+	defer bt.mux.RUnlock()
+	var tips []*treeNode
+	for _, node := range bt.nodes {
+		if node.children == 0 {
+			tips = append(tips, node)
+		}
+	}
+	sort.Slice(tips, func(i, j int) bool {
+		return tips[i].heavierThan(tips[j])
+	})
+	return tips
+}
+
+// best 最も重いチェーンの末尾を返します。
+func (bt *BlockTree) best() *treeNode {
+	tips := bt.tips()
+	if len(tips) == 0 {
+		return nil
+	}
+	return tips[0]
+}
+
+// orphanBlocks 保持している孤立ブロックを受け取った順に返します。
+func (bt *BlockTree) orphanBlocks() []*Block {
+	bt.mux.RLock()
+	defer bt.mux.RUnlock()
+	blocks := make([]*Block, 0, len(bt.order))
+	for _, hash := range bt.order {
+		blocks = append(blocks, bt.orphans[hash])
+	}
+	return blocks
+}
+
+// heavierThan ConsensusCandidateと同じく、累積の重みが多い方を、同じ場合はハッシュが小さい方を優先します。
+func (tn *treeNode) heavierThan(other *treeNode) bool {
+	if c := tn.work.Cmp(other.work); c != 0 {
+		return c > 0
+	}
+	return bytes.Compare(tn.hash[:], other.hash[:]) < 0
+}
+
+// ChainTip ブロックの木にあるチェーンの末尾の1つです。
+// BranchLengthは自ノードのチェーンから分岐した後のブロックの数で、ForkHeightは分岐した共通の祖先の高さです。
+type ChainTip struct {
+	Hash         [32]byte
+	Height       int
+	Work         *big.Int
+	ForkHeight   int
+	BranchLength int
+	Status       string
+}
+
+func (ct *ChainTip) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Hash         string `json:"hash"`
+		Height       int    `json:"height"`
+		Work         string `json:"work"`
+		ForkHeight   int    `json:"fork_height"`
+		BranchLength int    `json:"branch_length"`
+		Status       string `json:"status"`
+	}{
+		Hash:         fmt.Sprintf("%x", ct.Hash),
+		Height:       ct.Height,
+		Work:         ct.Work.String(),
+		ForkHeight:   ct.ForkHeight,
+		BranchLength: ct.BranchLength,
+		Status:       ct.Status,
+	})
+}
+
+// OrphanBlock 親が届くのを待っている孤立ブロックです。
+type OrphanBlock struct {
+	Hash         [32]byte
+	PreviousHash [32]byte
+	Timestamp    int64
+}
+
+func (ob *OrphanBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Hash         string `json:"hash"`
+		PreviousHash string `json:"previous_hash"`
+		Timestamp    int64  `json:"timestamp"`
+	}{
+		Hash:         fmt.Sprintf("%x", ob.Hash),
+		PreviousHash: fmt.Sprintf("%x", ob.PreviousHash),
+		Timestamp:    ob.Timestamp,
+	})
+}
+
+// Tips ブロックの木にある全てのチェーンの末尾を重い順に返します。
+func (bc *Blockchain) Tips() []*ChainTip {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	var tips []*ChainTip
+	for _, node := range bc.tree.tips() {
+		tip := &ChainTip{Hash: node.hash, Height: node.height, Work: node.work, Status: TipFork}
+		ancestor := node
+		for ancestor != nil && !bc.onChain(ancestor) {
+			tip.BranchLength++
+			ancestor = ancestor.parent
+		}
+		if ancestor != nil {
+			tip.ForkHeight = ancestor.height
+		}
+		if tip.BranchLength == 0 {
+			tip.Status = TipActive
+		}
+		tips = append(tips, tip)
+	}
+	return tips
+}
+
+// Orphans 親が届くのを待っている孤立ブロックを返します。
+func (bc *Blockchain) Orphans() []*OrphanBlock {
+	var orphans []*OrphanBlock
+	for _, b := range bc.tree.orphanBlocks() {
+		orphans = append(orphans, &OrphanBlock{Hash: b.Hash(), PreviousHash: b.PreviousHash, Timestamp: b.Timestamp})
+	}
+	return orphans
+}
+
+// onChain ブロックが自ノードのチェーンにあるか返します。
+func (bc *Blockchain) onChain(node *treeNode) bool {
+	b, err := bc.chain.BlockByHeight(node.height)
+	return err == nil && b.Hash() == node.hash
+}
+
+// ReceiveBlock 隣接ノードから届いた1つのブロックを検証してブロックの木に追加し、最も重いチェーンに切り替えます。
+// 親がまだない場合は孤立ブロックとして保持してErrOrphanBlockを返します。親が届くとそのブロックもつなぎます。
+func (bc *Blockchain) ReceiveBlock(b *Block) error {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	hash := b.Hash()
+	if bc.tree.has(hash) {
+		log.Printf("blockchain: action=receive_block, status=known, hash=%x", hash)
+		return nil
+	}
+	if !bc.tree.connected(b.PreviousHash) {
+		if err := bc.verifyOrphan(b); err != nil {
+			return fmt.Errorf("orphan %x: %v", hash, err)
+		}
+		bc.tree.addOrphan(b)
+		log.Printf("blockchain: action=receive_block, status=orphan, hash=%x, previous=%x", hash, b.PreviousHash)
+		return ErrOrphanBlock
+	}
+	if err := bc.connectBlock(b); err != nil {
+		return err
+	}
+	bc.connectOrphans()
+	return bc.activateBestTip()
+}
+
+// verifyOrphan 孤立ブロックを保持する前に、親がなくても確認できるサイズ、マークルルート、封印を検証します。
+func (bc *Blockchain) verifyOrphan(b *Block) error {
+	if size := transactionsSize(b.Transactions); size > MaxBlockSize {
+		return fmt.Errorf("transactions are %d bytes, limit is %d", size, MaxBlockSize)
+	}
+	if b.MerkleRoot != TransactionsMerkleRoot(b.Transactions) {
+		return errors.New("merkle root does not match transactions")
+	}
+	verifier, ok := bc.engine.(SealVerifier)
+	if !ok {
+		return fmt.Errorf("%s blocks cannot be verified without their parent", bc.engine.Name())
+	}
+	return verifier.VerifySeal(b.Header())
+}
+
+// ResolveOrphans 孤立ブロックの親を探すため、隣接ノードのチェーンと比べます。
+// 孤立ブロックが続けて届いても、前回からOrphanResolveIntervalSec経つまでは何もしません。
+func (bc *Blockchain) ResolveOrphans() {
+	bc.mux.Lock()
+	if time.Since(bc.orphanResolved) < OrphanResolveIntervalSec*time.Second {
+		bc.mux.Unlock()
+		return
+	}
+	bc.orphanResolved = time.Now()
+	bc.mux.Unlock()
+	bc.ResolveConflicts()
+}
+
+// connectBlock 親が木にあるブロックを検証してから木に追加します。
+// チェーンを最初から再生せず、親までを適用した状態に対してそのブロックだけを検証します。木にある親までの枝は追加したときに検証済みです。
+func (bc *Blockchain) connectBlock(b *Block) error {
+	chain := append(bc.tree.branch(b.PreviousHash), b)
+	fork, finalized := bc.forkHeight(chain), bc.finalizedHeight()
+	if fork <= finalized {
+		return fmt.Errorf("block forks at height %d before finalized block %d", fork, finalized)
+	}
+	height := len(chain) - 1
+	state, utxos := bc.branchState(chain[:height], fork)
+	maxTimestamp := time.Now().Add(MaxFutureBlockTimeSec * time.Second).UnixNano()
+	if err := bc.verifyChainBlock(chain, height, maxTimestamp, state, utxos); err != nil {
+		return err
+	}
+	bc.tree.add(b)
+	log.Printf("blockchain: action=receive_block, status=success, height=%d, hash=%x", height, b.Hash())
+	return nil
+}
+
+// branchState 自ノードの状態のコピーを共通の祖先(高さfork-1)まで巻き戻し、branchの祖先より後のブロックを適用して返します。
+// UTXO方式ではUTXOの集合をコピーし、アカウントの状態は検証に使う空のものを返します。
+func (bc *Blockchain) branchState(branch []*Block, fork int) (*accountState, *utxoSet) {
+	if bc.config.UTXO() {
+		utxos := bc.utxos.clone()
+		for h := bc.chain.Height() - 1; h >= fork; h-- {
+			utxos.revertBlock(bc.storedBlockAt(h))
+		}
+		for _, b := range branch[fork:] {
+			utxos.applyBlock(b)
+		}
+		state := newAccountState()
+		state.height = len(branch) - 1
+		return state, utxos
+	}
+	state := bc.state.clone()
+	for h := bc.chain.Height() - 1; h >= fork; h-- {
+		state.revertBlock(bc.storedBlockAt(h))
+	}
+	for _, b := range branch[fork:] {
+		state.applyBlock(b)
+	}
+	return state, nil
+}
+
+// connectOrphans 親が木につながった孤立ブロックを、つなげるものがなくなるまで検証して追加します。無効なものは捨てます。
+func (bc *Blockchain) connectOrphans() {
+	for ready := bc.tree.takeOrphans(); len(ready) > 0; ready = bc.tree.takeOrphans() {
+		for _, b := range ready {
+			if err := bc.connectBlock(b); err != nil {
+				log.Printf("ERROR: orphan %x: %v", b.Hash(), err)
+			}
+		}
+	}
+}
+
+// activateBestTip ブロックの木で最も重いチェーンが自ノードのチェーンより重ければ、保持しているブロックでそのチェーンに切り替えます。
+func (bc *Blockchain) activateBestTip() error {
+	best := bc.tree.best()
+	if best == nil || bc.onChain(best) {
+		return nil
+	}
+	local := bc.newConsensusCandidate(LocalPeer, bc.Chain())
+	candidate := &ConsensusCandidate{Work: best.work, TipHash: best.hash}
+	if !candidate.heavierThan(local) {
+		return nil
+	}
+	_, err := bc.reorganize(bc.tree.branch(best.hash))
+	return err
+}
@@ -0,0 +1,130 @@
+package block
+
+import "testing"
+
+// minedOrphan 親が木にない、難易度difficultyを満たすブロックを作ります。
+func minedOrphan(difficulty int, txs []*Transaction) *Block {
+	for nonce := 0; ; nonce++ {
+		b := NewBlock(nonce, [32]byte{0xaa}, difficulty, txs)
+		if hasLeadingZeroBits(b.Hash(), difficulty) {
+			return b
+		}
+	}
+}
+
+func TestReceiveOrphanVerifiesSeal(t *testing.T) {
+	_, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+
+	valid := minedOrphan(MinDifficulty+2, nil)
+	if err := bc.ReceiveBlock(valid); err != ErrOrphanBlock {
+		t.Fatalf("valid orphan: got %v, want ErrOrphanBlock", err)
+	}
+
+	unsealed := minedOrphan(MinDifficulty+2, nil)
+	for hasLeadingZeroBits(unsealed.Hash(), unsealed.Difficulty) {
+		unsealed.Nonce++
+	}
+	tampered := minedOrphan(MinDifficulty+2, nil)
+	tampered.Transactions = []*Transaction{NewTransaction(MiningSender, "mallory", Coin)}
+	for name, b := range map[string]*Block{
+		"no difficulty": minedOrphan(0, nil),
+		"invalid proof": unsealed,
+		"merkle root":   tampered,
+	} {
+		if err := bc.ReceiveBlock(b); err == nil || err == ErrOrphanBlock {
+			t.Errorf("%s: got %v, want the orphan to be rejected", name, err)
+		}
+	}
+	if orphans := bc.Orphans(); len(orphans) != 1 || orphans[0].Hash != valid.Hash() {
+		t.Errorf("kept %d orphans, want only the valid one", len(orphans))
+	}
+}
+
+// forkBlockchain bcの高さheightまでのブロックを共有する別のノードのチェーンを作ります。
+func forkBlockchain(t *testing.T, bc *Blockchain, miner string, height int) *Blockchain {
+	t.Helper()
+	store := NewMemoryBlockStore()
+	for h := 0; h <= height; h++ {
+		if err := store.PutBlock(bc.storedBlockAt(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other, err := NewBlockchainWithStore(miner, 0, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetMiningWorkers(1)
+	return other
+}
+
+// sealWith bcの先頭に続き、プールのトランザクションの後にtxsを入れたブロックを作ります。チェーンには追加しません。
+func sealWith(t *testing.T, bc *Blockchain, txs ...*Transaction) *Block {
+	t.Helper()
+	tmpl, err := bc.NewBlockTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.Transactions = append(tmpl.Transactions, txs...)
+	tmpl.Header.MerkleRoot = TransactionsMerkleRoot(tmpl.Transactions)
+	b, err := bc.engine.Seal(bc, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestConnectBlockUsesBranchState サイドチェーンのブロックを、自ノードの先頭ではなく親までの枝の状態で検証することを確認します。
+func TestConnectBlockUsesBranchState(t *testing.T) {
+	key, alice := newTestKey(t)
+	a := newTestBlockchain(t, alice)
+	b := forkBlockchain(t, a, "bob", 0)
+
+	// aliceの残高はaのチェーンにしかないので、ジェネシスブロックから分岐した枝では使えません
+	spend := sealWith(t, b, signedTransfer(t, key, "carol", Coin/2, 0, 0))
+	err := a.ReceiveBlock(spend)
+	if cve, ok := err.(*ChainValidationError); !ok || cve.Rule != RuleBalance {
+		t.Fatalf("side block spending funds from another branch: got %v, want rule %s", err, RuleBalance)
+	}
+	if err := a.ReceiveBlock(sealWith(t, b)); err != nil {
+		t.Fatal(err)
+	}
+	if tips := a.Tips(); len(tips) != 2 {
+		t.Fatalf("%d tips, want the chain and one side chain", len(tips))
+	}
+}
+
+func TestReceiveSideChainReorg(t *testing.T) {
+	_, alice := newTestKey(t)
+	a := newTestBlockchain(t, alice)
+	orphaned := a.LastBlock()
+	b := forkBlockchain(t, a, "bob", 0)
+	for i := 0; i < 2; i++ {
+		if !b.Mining() {
+			t.Fatal("mining failed")
+		}
+	}
+	chain := b.Chain()
+	for _, blk := range chain[1:] {
+		if err := a.ReceiveBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.LastBlock().Hash() != b.LastBlock().Hash() {
+		t.Fatal("did not switch to the heavier side chain")
+	}
+	if err := a.CheckBalanceIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.CalculateTotalAmount("bob"), b.CalculateTotalAmount("bob"); got != want {
+		t.Errorf("balance of bob = %s, want %s", got, want)
+	}
+	if got := a.CalculateTotalAmount(alice); got != 0 {
+		t.Errorf("reward of the orphaned block is still counted: %s", got)
+	}
+	for _, tip := range a.Tips() {
+		if tip.Hash == orphaned.Hash() && tip.Status != TipFork {
+			t.Errorf("orphaned block has status %s", tip.Status)
+		}
+	}
+}
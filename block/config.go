@@ -0,0 +1,114 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ChainConfig.Ledgerに指定できる台帳の方式です。
+const (
+	LedgerAccount = "account" // アドレスごとの残高とnonceで管理します(既定)
+	LedgerUTXO    = "utxo"    // 以前のトランザクションの出力を入力として参照して使います
+)
+
+// ChainConfig チェーン全体のルールです。最初のブロック(ジェネシスブロック)に保存され、そのハッシュに含まれます。
+type ChainConfig struct {
+	InitialDifficulty  int               // 最初の難易度(先頭ゼロビット数)
+	TargetBlockTimeSec int64             // 目標とするブロック間隔(秒)
+	RetargetInterval   int               // 難易度を調整するブロック数の間隔
+	Ledger             string            // 台帳の方式。空の場合はLedgerAccount
+	InitialReward      Amount            // 最初のマイニング報酬。0の場合はMiningReward
+	HalvingInterval    int               // マイニング報酬が半分になる間隔(ブロック数)。0の場合は半減しません
+	MaxSupply          Amount            // マイニング報酬で発行される量の上限。0の場合は上限なし
+	Consensus          string            // 合意の方式。空の場合はConsensusPoW
+	Authorities        []string          // PoAでブロックを作るアドレス(高さの順に交代します)、またはBFTのバリデーター
+	BlockPeriodSec     int64             // PoA、PoS、BFTでのブロックの間隔(秒)。BFTではラウンドのタイムアウトにも使います
+	GenesisStake       map[string]Amount // PoSで最初からステークを持つアドレスとその額
+}
+
+func DefaultChainConfig() *ChainConfig {
+	return &ChainConfig{
+		InitialDifficulty:  MiningDifficulty,
+		TargetBlockTimeSec: TargetBlockTimeSec,
+		RetargetInterval:   RetargetInterval,
+		InitialReward:      MiningReward,
+		HalvingInterval:    HalvingInterval,
+		MaxSupply:          MaxSupply,
+	}
+}
+
+// UTXO チェーンがUTXO方式の台帳を使うか返します。
+func (cc *ChainConfig) UTXO() bool {
+	return cc != nil && cc.Ledger == LedgerUTXO
+}
+
+// ValidLedger Ledgerが既知の方式か確認します。
+func (cc *ChainConfig) ValidLedger() bool {
+	return cc.Ledger == "" || cc.Ledger == LedgerAccount || cc.Ledger == LedgerUTXO
+}
+
+func (cc *ChainConfig) Equal(other *ChainConfig) bool {
+	if cc == nil || other == nil {
+		return cc == other
+	}
+	a, _ := json.Marshal(cc)
+	b, _ := json.Marshal(other)
+	return bytes.Equal(a, b)
+}
+
+func (cc *ChainConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		InitialDifficulty  int               `json:"initial_difficulty"`
+		TargetBlockTimeSec int64             `json:"target_block_time_sec"`
+		RetargetInterval   int               `json:"retarget_interval"`
+		Ledger             string            `json:"ledger,omitempty"`
+		InitialReward      Amount            `json:"initial_reward,omitempty"`
+		HalvingInterval    int               `json:"halving_interval,omitempty"`
+		MaxSupply          Amount            `json:"max_supply,omitempty"`
+		Consensus          string            `json:"consensus,omitempty"`
+		Authorities        []string          `json:"authorities,omitempty"`
+		BlockPeriodSec     int64             `json:"block_period_sec,omitempty"`
+		GenesisStake       map[string]Amount `json:"genesis_stake,omitempty"`
+	}{
+		InitialDifficulty:  cc.InitialDifficulty,
+		TargetBlockTimeSec: cc.TargetBlockTimeSec,
+		RetargetInterval:   cc.RetargetInterval,
+		Ledger:             cc.Ledger,
+		InitialReward:      cc.InitialReward,
+		HalvingInterval:    cc.HalvingInterval,
+		MaxSupply:          cc.MaxSupply,
+		Consensus:          cc.Consensus,
+		Authorities:        cc.Authorities,
+		BlockPeriodSec:     cc.BlockPeriodSec,
+		GenesisStake:       cc.GenesisStake,
+	})
+}
+
+func (cc *ChainConfig) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		InitialDifficulty  *int               `json:"initial_difficulty"`
+		TargetBlockTimeSec *int64             `json:"target_block_time_sec"`
+		RetargetInterval   *int               `json:"retarget_interval"`
+		Ledger             *string            `json:"ledger"`
+		InitialReward      *Amount            `json:"initial_reward"`
+		HalvingInterval    *int               `json:"halving_interval"`
+		MaxSupply          *Amount            `json:"max_supply"`
+		Consensus          *string            `json:"consensus"`
+		Authorities        *[]string          `json:"authorities"`
+		BlockPeriodSec     *int64             `json:"block_period_sec"`
+		GenesisStake       *map[string]Amount `json:"genesis_stake"`
+	}{
+		InitialDifficulty:  &cc.InitialDifficulty,
+		TargetBlockTimeSec: &cc.TargetBlockTimeSec,
+		RetargetInterval:   &cc.RetargetInterval,
+		Ledger:             &cc.Ledger,
+		InitialReward:      &cc.InitialReward,
+		HalvingInterval:    &cc.HalvingInterval,
+		MaxSupply:          &cc.MaxSupply,
+		Consensus:          &cc.Consensus,
+		Authorities:        &cc.Authorities,
+		BlockPeriodSec:     &cc.BlockPeriodSec,
+		GenesisStake:       &cc.GenesisStake,
+	}
+	return json.Unmarshal(data, v)
+}
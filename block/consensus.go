@@ -0,0 +1,175 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// ChainConfig.Consensusに指定できる合意の方式です。
+const (
+	ConsensusPoW = "pow" // プルーフオブワーク(既定)
+)
+
+// ErrSealAborted 封印の途中でチェーンの先頭が変わり、中断したことを表します。
+var ErrSealAborted = errors.New("seal aborted: chain tip changed")
+
+// BlockAtFunc 検証中や作成中のチェーンで、指定した高さのブロックを返します。
+type BlockAtFunc func(height int) *Block
+
+// Consensus ブロックの作成と検証のうち、合意の方式によって変わる部分です。
+// 方式はジェネシスブロックのChainConfig.Consensusで選び、RegisterConsensusで追加できます。
+type Consensus interface {
+	Name() string
+	// Prepare 高さheightのブロックのヘッダーに、合意に必要な値(PoWでは難易度)を設定します。
+	Prepare(blockAt BlockAtFunc, height int, header *BlockHeader) error
+	// Seal テンプレートからチェーンに追加できるブロックを作ります。先頭が変わったらErrSealAbortedを返します。
+	Seal(bc *Blockchain, tmpl *BlockTemplate) (*Block, error)
+	// VerifyHeader 高さheightのブロックのヘッダーが合意のルールを満たすか検証します。*ChainValidationErrorを返します。
+	VerifyHeader(blockAt BlockAtFunc, height int, header *BlockHeader) error
+	// Weight フォーク選択でのブロック1つ分の重みです。重みの合計が大きいチェーンを選びます。
+	Weight(header *BlockHeader) *big.Int
+}
+
+// BlockScheduler 決まった時刻に決まったノードがブロックを作る合意の方式が実装します。
+// この方式ではStartMiningは一定間隔のタイマーの代わりに、NextBlockTimeに従ってブロックを作ります。
+type BlockScheduler interface {
+	// NextBlockTime 自ノードが次のブロックを作る番であれば、その時刻とtrueを返します。
+	NextBlockTime(bc *Blockchain) (time.Time, bool)
+}
+
+// BlockVerifier ヘッダーだけでなくブロックのトランザクションにも条件がある合意の方式が実装します。
+// VerifyChainとCommitBlockでVerifyHeaderの後に呼ばれます。
+type BlockVerifier interface {
+	VerifyBlock(height int, b *Block) error
+}
+
+// SealVerifier 親のブロックがなくても確認できる封印(プルーフオブワークや署名)を検証する合意の方式が実装します。
+// 孤立ブロックを保持する前に呼ばれます。実装しない方式の孤立ブロックは保持しません。
+type SealVerifier interface {
+	VerifySeal(header *BlockHeader) error
+}
+
+// Finality ブロックを確定させる合意の方式が実装します。確定したブロックより前で分岐するチェーンには置き換えません。
+type Finality interface {
+	IsFinal(b *Block) bool
+}
+
+// Runner 複数のノードのやり取りでブロックを作る合意の方式(BFTなど)が実装します。StartMiningはタイマーの代わりにRunを呼びます。
+type Runner interface {
+	Run(bc *Blockchain)
+}
+
+// schedulerPollInterval BlockSchedulerの番が来たか確認する間隔です。
+const schedulerPollInterval = time.Second
+
+// ConsensusFactory チェーン設定から合意の方式を作ります。
+type ConsensusFactory func(config *ChainConfig) (Consensus, error)
+
+var (
+	consensusEngines   = map[string]ConsensusFactory{ConsensusPoW: newProofOfWork}
+	muxConsensusEngine sync.RWMutex
+)
+
+// RegisterConsensus nameの合意の方式を登録します。
+func RegisterConsensus(name string, factory ConsensusFactory) {
+	muxConsensusEngine.Lock()
+	defer muxConsensusEngine.Unlock()
+	consensusEngines[name] = factory
+}
+
+// NewConsensus configの合意の方式を作ります。Consensusが空の場合はプルーフオブワークです。
+func NewConsensus(config *ChainConfig) (Consensus, error) {
+	name := ConsensusPoW
+	if config != nil && config.Consensus != "" {
+		name = config.Consensus
+	}
+	muxConsensusEngine.RLock()
+	factory, ok := consensusEngines[name]
+	muxConsensusEngine.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown consensus %q", name)
+	}
+	return factory(config)
+}
+
+// Consensus チェーンの合意の方式を返します。
+func (bc *Blockchain) Consensus() Consensus {
+	return bc.engine
+}
+
+// storedBlockAt BlockStoreから高さheightのブロックを返します。
+func (bc *Blockchain) storedBlockAt(height int) *Block {
+	b, err := bc.chain.BlockByHeight(height)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	return b
+}
+
+// chainWeight チェーン全体の重みの合計を返します。
+func (bc *Blockchain) chainWeight(chain []*Block) *big.Int {
+	weight := new(big.Int)
+	for _, b := range chain {
+		weight.Add(weight, bc.engine.Weight(b.Header()))
+	}
+	return weight
+}
+
+// verifyBlock 合意の方式がBlockVerifierであれば、ブロック全体を検証します。
+func (bc *Blockchain) verifyBlock(height int, b *Block) error {
+	if verifier, ok := bc.engine.(BlockVerifier); ok {
+		return verifier.VerifyBlock(height, b)
+	}
+	return nil
+}
+
+// finalizedHeight 確定した最も高いブロックの高さを返します。確定したブロックがない場合や、合意の方式がFinalityでない場合は-1です。
+func (bc *Blockchain) finalizedHeight() int {
+	finality, ok := bc.engine.(Finality)
+	if !ok {
+		return -1
+	}
+	for height := bc.chain.Height() - 1; height > 0; height-- {
+		if finality.IsFinal(bc.storedBlockAt(height)) {
+			return height
+		}
+	}
+	return -1
+}
+
+// rewardAddress マイニング報酬の受取人です。署名する鍵があればそのアドレス、なければノードのアドレスです。
+func (bc *Blockchain) rewardAddress() string {
+	if bc.signer != nil {
+		return utils.AddressFromPublicKey(&bc.signer.PublicKey)
+	}
+	return bc.blockchainAddress
+}
+
+// SetSigner ブロックに署名する鍵を設定します。署名でブロックを封印する合意の方式で使います。
+func (bc *Blockchain) SetSigner(key *ecdsa.PrivateKey) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.signer = key
+}
+
+func (bc *Blockchain) Signer() *ecdsa.PrivateKey {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.signer
+}
+
+// produceScheduled BlockSchedulerの番が来たらブロックを作り、schedulerPollIntervalごとに繰り返します。
+func (bc *Blockchain) produceScheduled(scheduler BlockScheduler) {
+	if at, ok := scheduler.NextBlockTime(bc); ok && !time.Now().Before(at) {
+		bc.Mining()
+	}
+	time.AfterFunc(schedulerPollInterval, func() {
+		bc.produceScheduled(scheduler)
+	})
+}
@@ -0,0 +1,73 @@
+package block
+
+import "math"
+
+// hasLeadingZeroBits hashの先頭bitsビットが全てゼロか確認します。
+func hasLeadingZeroBits(hash [32]byte, bits int) bool {
+	if bits < 0 || bits > len(hash)*8 {
+		return false
+	}
+	for i := 0; i < bits/8; i++ {
+		if hash[i] != 0 {
+			return false
+		}
+	}
+	if r := bits % 8; r != 0 {
+		return hash[bits/8]>>(8-r) == 0
+	}
+	return true
+}
+
+// nextDifficulty 高さheightのブロックに要求される難易度を計算します。blockAtはheightより前のブロックを返します。
+// RetargetIntervalごとに、直前の区間のブロック間隔を目標と比べて最大±MaxDifficultyStepビット調整します。
+func nextDifficulty(config *ChainConfig, height int, blockAt func(height int) *Block) int {
+	if height == 0 {
+		return config.InitialDifficulty
+	}
+	parent := blockAt(height - 1)
+	if config.RetargetInterval <= 0 || height%config.RetargetInterval != 0 {
+		return parent.Difficulty
+	}
+
+	firstHeight := height - config.RetargetInterval - 1
+	if firstHeight < 0 {
+		firstHeight = 0
+	}
+	first := blockAt(firstHeight)
+	intervals := int64(height - 1 - firstHeight)
+	if intervals <= 0 {
+		return parent.Difficulty
+	}
+
+	expectedMs := config.TargetBlockTimeSec * 1000 * intervals
+	actualMs := (parent.Timestamp - first.Timestamp) / 1e6
+	if actualMs < expectedMs/4 {
+		actualMs = expectedMs / 4
+	}
+	if actualMs > expectedMs*4 {
+		actualMs = expectedMs * 4
+	}
+	if actualMs < 1 {
+		actualMs = 1
+	}
+
+	// 実際の間隔が目標の1/√2以下なら1ビット上げ、√2倍以上なら1ビット下げる
+	// 長い区間ではミリ秒の2乗がint64に収まらないので、比で比べます
+	ratio := float64(actualMs) / float64(expectedMs)
+	difficulty := parent.Difficulty
+	for step := 0; step < MaxDifficultyStep && ratio <= 1/math.Sqrt2; step++ {
+		difficulty++
+		ratio *= 2
+	}
+	for step := 0; step < MaxDifficultyStep && ratio >= math.Sqrt2; step++ {
+		difficulty--
+		ratio /= 2
+	}
+	if difficulty < MinDifficulty {
+		difficulty = MinDifficulty
+	}
+	if difficulty > MaxDifficulty {
+		difficulty = MaxDifficulty
+	}
+	return difficulty
+}
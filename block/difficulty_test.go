@@ -0,0 +1,75 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHasLeadingZeroBits(t *testing.T) {
+	hash := [32]byte{0x00, 0x0f, 0xff}
+	tests := []struct {
+		bits int
+		want bool
+	}{
+		{0, true},
+		{8, true},
+		{12, true},
+		{13, false},
+		{-1, false},
+		{257, false},
+	}
+	for _, tt := range tests {
+		if got := hasLeadingZeroBits(hash, tt.bits); got != tt.want {
+			t.Errorf("hasLeadingZeroBits(%x, %d) = %t, want %t", hash[:3], tt.bits, got, tt.want)
+		}
+	}
+	if !hasLeadingZeroBits([32]byte{}, 256) {
+		t.Error("zero hash does not have 256 leading zero bits")
+	}
+}
+
+// evenChain n個のブロックが難易度difficultyでinterval間隔に並んだチェーンを返します。
+func evenChain(n, difficulty int, interval time.Duration) []*Block {
+	chain := make([]*Block, n)
+	start := time.Unix(1700000000, 0)
+	for i := range chain {
+		chain[i] = &Block{Timestamp: start.Add(time.Duration(i) * interval).UnixNano(), Difficulty: difficulty}
+	}
+	return chain
+}
+
+// TestNextDifficulty 調整間隔ごとに実際の間隔に合わせて難易度が上下し、MaxDifficultyStepと上下限で抑えられることを確認します。
+func TestNextDifficulty(t *testing.T) {
+	small := &ChainConfig{InitialDifficulty: 10, TargetBlockTimeSec: 30, RetargetInterval: 10}
+	// ミリ秒の2乗がint64を超える長い区間です
+	large := &ChainConfig{InitialDifficulty: 20, TargetBlockTimeSec: 600, RetargetInterval: 2016}
+	tests := []struct {
+		name       string
+		config     *ChainConfig
+		height     int
+		difficulty int
+		interval   time.Duration
+		want       int
+	}{
+		{"genesis", small, 0, 10, 30 * time.Second, 10},
+		{"between retargets", small, 5, 10, time.Second, 10},
+		{"on target", small, 10, 10, 30 * time.Second, 10},
+		{"twice as fast", small, 10, 10, 15 * time.Second, 11},
+		{"much faster is limited to the step", small, 10, 10, time.Second, 10 + MaxDifficultyStep},
+		{"twice as slow", small, 10, 10, 60 * time.Second, 9},
+		{"much slower is limited to the step", small, 10, 10, 10 * time.Minute, 10 - MaxDifficultyStep},
+		{"minimum", small, 10, MinDifficulty, 10 * time.Minute, MinDifficulty},
+		{"maximum", small, 10, MaxDifficulty, time.Second, MaxDifficulty},
+		{"large window, three times as slow", large, 2016, 20, 30 * time.Minute, 18},
+		{"large window, three times as fast", large, 2016, 20, 200 * time.Second, 22},
+	}
+	for _, tt := range tests {
+		chain := evenChain(tt.height+1, tt.difficulty, tt.interval)
+		blockAt := func(height int) *Block {
+			return chain[height]
+		}
+		if got := nextDifficulty(tt.config, tt.height, blockAt); got != tt.want {
+			t.Errorf("%s: nextDifficulty = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
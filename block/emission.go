@@ -0,0 +1,128 @@
+package block
+
+import "encoding/json"
+
+// initialReward 最初のマイニング報酬です。以前のジェネシスブロックの設定には無いのでMiningRewardを使います。
+func (cc *ChainConfig) initialReward() Amount {
+	if cc == nil || cc.InitialReward == 0 {
+		return MiningReward
+	}
+	return cc.InitialReward
+}
+
+// scheduledReward 上限を考えない、heightのブロックのマイニング報酬です。HalvingIntervalごとに半分になります。
+func (cc *ChainConfig) scheduledReward(height int) Amount {
+	reward := cc.initialReward()
+	if cc == nil || cc.HalvingInterval <= 0 {
+		return reward
+	}
+	halvings := height / cc.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return reward >> uint(halvings)
+}
+
+// scheduledSupply 高さ1からheight-1までのブロックのマイニング報酬の合計(上限を考えない)です。
+func (cc *ChainConfig) scheduledSupply(height int) Amount {
+	if height <= 1 {
+		return 0
+	}
+	if cc == nil || cc.HalvingInterval <= 0 {
+		return cc.initialReward() * Amount(height-1)
+	}
+	var supply Amount
+	for start := 1; start < height; {
+		reward := cc.scheduledReward(start)
+		if reward == 0 {
+			break
+		}
+		end := (start/cc.HalvingInterval + 1) * cc.HalvingInterval
+		if end > height {
+			end = height
+		}
+		supply += reward * Amount(end-start)
+		start = end
+	}
+	return supply
+}
+
+// BlockReward heightのブロックのマイニング報酬(手数料を除く)です。
+// 報酬の合計がMaxSupplyを超える分は支払われず、上限に達した後の報酬は0になります。
+func (cc *ChainConfig) BlockReward(height int) Amount {
+	if height <= 0 {
+		return 0
+	}
+	reward := cc.scheduledReward(height)
+	if cc == nil || cc.MaxSupply <= 0 {
+		return reward
+	}
+	remaining := cc.MaxSupply - cc.scheduledSupply(height)
+	if remaining <= 0 {
+		return 0
+	}
+	if reward > remaining {
+		return remaining
+	}
+	return reward
+}
+
+// blockIssuance ブロックで新しく発行された量です。マイニング報酬からブロック内の手数料を差し引いたものです。
+func blockIssuance(b *Block) Amount {
+	var issued Amount
+	for _, t := range b.Transactions {
+		if t.SenderBlockchainAddress == MiningSender {
+			issued += t.Value
+		} else {
+			issued -= t.Fee
+		}
+	}
+	return issued
+}
+
+// SupplyInfo 発行量と現在のマイニング報酬です。
+type SupplyInfo struct {
+	Height            int
+	CirculatingSupply Amount
+	CurrentReward     Amount // 次のブロックのマイニング報酬
+	MaxSupply         Amount
+	HalvingInterval   int
+	NextHalvingHeight int // 半減しない場合は-1
+}
+
+// Supply チェーンで発行された量と次のブロックのマイニング報酬を返します。
+func (bc *Blockchain) Supply() *SupplyInfo {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	height := bc.chain.Height()
+	info := &SupplyInfo{
+		Height:            height,
+		CirculatingSupply: bc.supply,
+		CurrentReward:     bc.config.BlockReward(height),
+		MaxSupply:         bc.config.MaxSupply,
+		HalvingInterval:   bc.config.HalvingInterval,
+		NextHalvingHeight: -1,
+	}
+	if interval := bc.config.HalvingInterval; interval > 0 && info.CurrentReward > 0 {
+		info.NextHalvingHeight = (height/interval + 1) * interval
+	}
+	return info
+}
+
+func (si *SupplyInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Height            int    `json:"height"`
+		CirculatingSupply Amount `json:"circulating_supply"`
+		CurrentReward     Amount `json:"current_reward"`
+		MaxSupply         Amount `json:"max_supply"`
+		HalvingInterval   int    `json:"halving_interval"`
+		NextHalvingHeight int    `json:"next_halving_height"`
+	}{
+		Height:            si.Height,
+		CirculatingSupply: si.CirculatingSupply,
+		CurrentReward:     si.CurrentReward,
+		MaxSupply:         si.MaxSupply,
+		HalvingInterval:   si.HalvingInterval,
+		NextHalvingHeight: si.NextHalvingHeight,
+	})
+}
@@ -0,0 +1,163 @@
+package block
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	blockStoreFileName = "blocks.kv"
+
+	keyBlockPrefix  = "block/"
+	keyHeightPrefix = "height/"
+	keyTipHeight    = "tip"
+)
+
+// FileBlockStore データディレクトリ内のキーバリューファイルにブロックを保存するBlockStoreです。
+//
+//	block/<hash>   ブロックのJSON
+//	height/<高さ>  その高さのブロックハッシュ
+//	tip            保存されているブロックの数
+type FileBlockStore struct {
+	kv     *kvStore
+	height int
+	mux    sync.RWMutex
+}
+
+func OpenFileBlockStore(dataDir string) (*FileBlockStore, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	kv, err := openKVStore(filepath.Join(dataDir, blockStoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileBlockStore{kv: kv}
+	if v, ok := kv.Get(keyTipHeight); ok {
+		fs.height = int(binary.BigEndian.Uint64(v))
+	}
+	return fs, nil
+}
+
+func blockKey(hash [32]byte) string {
+	return fmt.Sprintf("%s%x", keyBlockPrefix, hash)
+}
+
+func heightKey(height int) string {
+	return fmt.Sprintf("%s%016x", keyHeightPrefix, height)
+}
+
+func tipValue(height int) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(height))
+	return v
+}
+
+func (fs *FileBlockStore) PutBlock(b *Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.writeFrom(fs.height, []*Block{b})
+}
+
+func (fs *FileBlockStore) ReplaceFrom(height int, blocks []*Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if height < 0 || height > fs.height {
+		return ErrBlockNotFound
+	}
+	return fs.writeFrom(height, blocks)
+}
+
+func (fs *FileBlockStore) writeFrom(height int, blocks []*Block) error {
+	var ops []kvOp
+	for h := height; h < fs.height; h++ {
+		if hash, ok := fs.kv.Get(heightKey(h)); ok {
+			var hh [32]byte
+			copy(hh[:], hash)
+			ops = append(ops, kvOp{op: kvOpDel, key: blockKey(hh)})
+		}
+		ops = append(ops, kvOp{op: kvOpDel, key: heightKey(h)})
+	}
+	for i, b := range blocks {
+		m, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		hash := b.Hash()
+		ops = append(ops,
+			kvOp{op: kvOpPut, key: blockKey(hash), value: m},
+			kvOp{op: kvOpPut, key: heightKey(height + i), value: hash[:]})
+	}
+	newHeight := height + len(blocks)
+	ops = append(ops, kvOp{op: kvOpPut, key: keyTipHeight, value: tipValue(newHeight)})
+	if err := fs.kv.Write(ops); err != nil {
+		return err
+	}
+	fs.height = newHeight
+	return nil
+}
+
+func (fs *FileBlockStore) BlockByHash(hash [32]byte) (*Block, error) {
+	m, ok := fs.kv.Get(blockKey(hash))
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	var b Block
+	if err := json.Unmarshal(m, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (fs *FileBlockStore) BlockByHeight(height int) (*Block, error) {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	return fs.blockByHeight(height)
+}
+
+func (fs *FileBlockStore) blockByHeight(height int) (*Block, error) {
+	if height < 0 || height >= fs.height {
+		return nil, ErrBlockNotFound
+	}
+	hash, ok := fs.kv.Get(heightKey(height))
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	var h [32]byte
+	copy(h[:], hash)
+	return fs.BlockByHash(h)
+}
+
+func (fs *FileBlockStore) Tip() (*Block, error) {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	return fs.blockByHeight(fs.height - 1)
+}
+
+func (fs *FileBlockStore) Height() int {
+	fs.mux.RLock()
+	defer fs.mux.RUnlock()
+	return fs.height
+}
+
+func (fs *FileBlockStore) Iterate(fn func(height int, b *Block) bool) error {
+	height := fs.Height()
+	for h := 0; h < height; h++ {
+		b, err := fs.BlockByHeight(h)
+		if err != nil {
+			return err
+		}
+		if !fn(h, b) {
+			break
+		}
+	}
+	return nil
+}
+
+func (fs *FileBlockStore) Close() error {
+	return fs.kv.Close()
+}
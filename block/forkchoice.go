@@ -0,0 +1,106 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// LocalPeer ConsensusCandidateで自ノードのチェーンを表す名前です。
+const LocalPeer = "local"
+
+// BlockWork 難易度difficultyのブロック1つ分の期待計算量(2^difficulty)を返します。
+func BlockWork(difficulty int) *big.Int {
+	if difficulty < 0 {
+		difficulty = 0
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+// ChainWork チェーン全体の累積計算量を返します。
+func ChainWork(chain []*Block) *big.Int {
+	work := new(big.Int)
+	for _, b := range chain {
+		work.Add(work, BlockWork(b.Difficulty))
+	}
+	return work
+}
+
+// ConsensusCandidate ResolveConflictsで比較したチェーンの1つです。
+type ConsensusCandidate struct {
+	Peer    string
+	Length  int
+	Work    *big.Int
+	TipHash [32]byte
+	Valid   bool
+}
+
+// heavierThan 累積計算量が多い方を優先し、同じ場合は末尾のブロックハッシュが小さい方を優先します。
+func (cc *ConsensusCandidate) heavierThan(other *ConsensusCandidate) bool {
+	if c := cc.Work.Cmp(other.Work); c != 0 {
+		return c > 0
+	}
+	return bytes.Compare(cc.TipHash[:], other.TipHash[:]) < 0
+}
+
+func (cc *ConsensusCandidate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Peer    string `json:"peer"`
+		Length  int    `json:"length"`
+		Work    string `json:"work"`
+		TipHash string `json:"tip_hash"`
+		Valid   bool   `json:"valid"`
+	}{
+		Peer:    cc.Peer,
+		Length:  cc.Length,
+		Work:    cc.Work.String(),
+		TipHash: fmt.Sprintf("%x", cc.TipHash),
+		Valid:   cc.Valid,
+	})
+}
+
+// ConsensusResult ResolveConflictsの結果です。Winnerは採用したチェーンのピア(自ノードのままならLocalPeer)です。
+// チェーンを置き換えた場合、Reorgにその再編成の結果が入ります。
+type ConsensusResult struct {
+	Replaced   bool
+	Winner     string
+	Local      *ConsensusCandidate
+	Candidates []*ConsensusCandidate
+	Reorg      *ReorgEvent
+}
+
+func (cr *ConsensusResult) MarshalJSON() ([]byte, error) {
+	message := "fail"
+	if cr.Replaced {
+		message = "success"
+	}
+	return json.Marshal(struct {
+		Message    string                `json:"message"`
+		Replaced   bool                  `json:"replaced"`
+		Winner     string                `json:"winner"`
+		Local      *ConsensusCandidate   `json:"local"`
+		Candidates []*ConsensusCandidate `json:"candidates"`
+		Reorg      *ReorgEvent           `json:"reorg,omitempty"`
+	}{
+		Message:    message,
+		Replaced:   cr.Replaced,
+		Winner:     cr.Winner,
+		Local:      cr.Local,
+		Candidates: cr.Candidates,
+		Reorg:      cr.Reorg,
+	})
+}
+
+// newConsensusCandidate chainの重みを合意の方式で計算します。
+func (bc *Blockchain) newConsensusCandidate(peer string, chain []*Block) *ConsensusCandidate {
+	cc := &ConsensusCandidate{
+		Peer:   peer,
+		Length: len(chain),
+		Work:   bc.chainWeight(chain),
+	}
+	if len(chain) > 0 {
+		cc.TipHash = chain[len(chain)-1].Hash()
+	}
+	return cc
+}
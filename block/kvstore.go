@@ -0,0 +1,264 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	kvOpPut byte = 1
+	kvOpDel byte = 2
+
+	kvMaxRecordSize    = 256 * 1024 * 1024
+	kvCompactChunkSize = 16 * 1024 * 1024
+)
+
+var errKVCorrupt = errors.New("kvstore: corrupt record")
+
+type kvOp struct {
+	op    byte
+	key   string
+	value []byte
+}
+
+// kvStore 追記型ログファイルに保存する小さなキーバリューストアです。
+// 1回の書き込み(バッチ)が1レコードになり、CRCで検証されるため、途中で落ちても中途半端なバッチは適用されません。
+// 起動時にログを再生して全てのキーをメモリ上に持ちます。
+type kvStore struct {
+	path string
+	file *os.File
+	data map[string][]byte
+	mux  sync.RWMutex
+
+	size     int64
+	liveSize int64
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	kv := &kvStore{path: path, data: make(map[string][]byte)}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	good, err := kv.replay(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != good {
+		log.Printf("WARNING: kvstore: truncating %d bytes of incomplete data in %s", info.Size()-good, path)
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	kv.file = f
+	kv.size = good
+	if kv.size > 2*kv.liveSize && kv.size > 1024*1024 {
+		if err := kv.compact(); err != nil {
+			log.Printf("ERROR: kvstore: compact %s: %v", path, err)
+		}
+	}
+	return kv, nil
+}
+
+// replay ファイル先頭からレコードを読み込み、正常に読めた末尾のオフセットを返します。
+// 書き込みの途中で落ちた最後のレコードだけを読み飛ばし、後ろにまだデータがある壊れたレコードはエラーにします。
+func (kv *kvStore) replay(f *os.File, size int64) (int64, error) {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		ops, n, err := readKVRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		}
+		if err == errKVCorrupt && n > 0 && offset+n == size {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: offset %d: %v", kv.path, offset, err)
+		}
+		kv.apply(ops)
+		offset += n
+	}
+}
+
+func (kv *kvStore) apply(ops []kvOp) {
+	for _, o := range ops {
+		if old, ok := kv.data[o.key]; ok {
+			kv.liveSize -= int64(len(o.key) + len(old))
+		}
+		switch o.op {
+		case kvOpPut:
+			kv.data[o.key] = o.value
+			kv.liveSize += int64(len(o.key) + len(o.value))
+		case kvOpDel:
+			delete(kv.data, o.key)
+		}
+	}
+}
+
+func readKVRecord(r *bufio.Reader) ([]kvOp, int64, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	sum := binary.BigEndian.Uint32(head[4:])
+	if length > kvMaxRecordSize {
+		return nil, 0, errKVCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		// チェックサムが合わない場合もレコードの長さは返し、最後のレコードか判断できるようにします
+		return nil, int64(len(head)) + int64(length), errKVCorrupt
+	}
+	ops, err := decodeKVOps(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ops, int64(len(head)) + int64(length), nil
+}
+
+func decodeKVOps(payload []byte) ([]kvOp, error) {
+	var ops []kvOp
+	for len(payload) > 0 {
+		o := kvOp{op: payload[0]}
+		payload = payload[1:]
+		kl, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < kl {
+			return nil, errKVCorrupt
+		}
+		o.key = string(payload[n : n+int(kl)])
+		payload = payload[n+int(kl):]
+		vl, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < vl {
+			return nil, errKVCorrupt
+		}
+		o.value = append([]byte(nil), payload[n:n+int(vl)]...)
+		payload = payload[n+int(vl):]
+		ops = append(ops, o)
+	}
+	return ops, nil
+}
+
+func encodeKVRecord(ops []kvOp) []byte {
+	var payload []byte
+	var buf [binary.MaxVarintLen64]byte
+	for _, o := range ops {
+		payload = append(payload, o.op)
+		n := binary.PutUvarint(buf[:], uint64(len(o.key)))
+		payload = append(payload, buf[:n]...)
+		payload = append(payload, o.key...)
+		n = binary.PutUvarint(buf[:], uint64(len(o.value)))
+		payload = append(payload, buf[:n]...)
+		payload = append(payload, o.value...)
+	}
+	record := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func (kv *kvStore) Get(key string) ([]byte, bool) {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	v, ok := kv.data[key]
+	return v, ok
+}
+
+// Write opsを1つのレコードとしてまとめて書き込みます。
+// 書き込みに失敗した場合は途中まで書いたレコードを切り詰め、次の書き込みが壊れたレコードの後ろに続かないようにします。
+func (kv *kvStore) Write(ops []kvOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	record := encodeKVRecord(ops)
+	if _, err := kv.file.Write(record); err != nil {
+		return kv.rollback(err)
+	}
+	if err := kv.file.Sync(); err != nil {
+		return kv.rollback(err)
+	}
+	kv.size += int64(len(record))
+	kv.apply(ops)
+	return nil
+}
+
+// rollback ファイルを最後に書き込みに成功した位置kv.sizeまで戻し、書き込みのエラーerrを返します。
+func (kv *kvStore) rollback(err error) error {
+	if terr := kv.file.Truncate(kv.size); terr != nil {
+		log.Printf("ERROR: kvstore: truncate %s: %v", kv.path, terr)
+	}
+	if _, serr := kv.file.Seek(kv.size, io.SeekStart); serr != nil {
+		log.Printf("ERROR: kvstore: seek %s: %v", kv.path, serr)
+	}
+	return err
+}
+
+// compact 現在の内容だけを新しいファイルに書き出して差し替えます。
+func (kv *kvStore) compact() error {
+	ops := make([]kvOp, 0, len(kv.data))
+	for k, v := range kv.data {
+		ops = append(ops, kvOp{op: kvOpPut, key: k, value: v})
+	}
+	tmp := kv.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for start := 0; start < len(ops); {
+		end, chunk := start, 0
+		for end < len(ops) && (end == start || chunk+len(ops[end].key)+len(ops[end].value) < kvCompactChunkSize) {
+			chunk += len(ops[end].key) + len(ops[end].value)
+			end++
+		}
+		record := encodeKVRecord(ops[start:end])
+		if _, err := f.Write(record); err != nil {
+			f.Close()
+			return err
+		}
+		size += int64(len(record))
+		start = end
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, kv.path); err != nil {
+		f.Close()
+		return err
+	}
+	kv.file.Close()
+	kv.file = f
+	kv.size = size
+	return nil
+}
+
+func (kv *kvStore) Close() error {
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	return kv.file.Close()
+}
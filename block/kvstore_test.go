@@ -0,0 +1,105 @@
+package block
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestKVStoreRollback 書き込みに失敗して途中まで残ったレコードを切り詰め、後の書き込みが再読み込みで失われないことを確認します。
+func TestKVStoreRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	kv, err := openKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Write([]kvOp{{op: kvOpPut, key: "a", value: []byte("1")}}); err != nil {
+		t.Fatal(err)
+	}
+	// 書き込みの途中で失敗した状態を作ります
+	partial := encodeKVRecord([]kvOp{{op: kvOpPut, key: "lost", value: []byte("x")}})
+	if _, err := kv.file.Write(partial[:len(partial)/2]); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("disk full")
+	if err := kv.rollback(failed); err != failed {
+		t.Fatalf("rollback returned %v", err)
+	}
+	if err := kv.Write([]kvOp{{op: kvOpPut, key: "b", value: []byte("2")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = openKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if v, ok := kv.Get(key); !ok || string(v) != want {
+			t.Errorf("%s = %q, %t after reopening, want %q", key, v, ok, want)
+		}
+	}
+	if _, ok := kv.Get("lost"); ok {
+		t.Error("the failed write was replayed")
+	}
+}
+
+// TestKVStoreReplayCorruption 書きかけの最後のレコードだけを切り詰め、途中の壊れたレコードはエラーにすることを確認します。
+func TestKVStoreReplayCorruption(t *testing.T) {
+	first := encodeKVRecord([]kvOp{{op: kvOpPut, key: "a", value: []byte("1")}})
+	second := encodeKVRecord([]kvOp{{op: kvOpPut, key: "b", value: []byte("2")}})
+	damaged := append([]byte(nil), second...)
+	damaged[len(damaged)-1] ^= 0xff
+	join := func(records ...[]byte) []byte {
+		var data []byte
+		for _, r := range records {
+			data = append(data, r...)
+		}
+		return data
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"torn tail", join(first, second[:len(second)-1]), false},
+		{"torn header", join(first, second[:3]), false},
+		{"bad checksum in the last record", join(first, damaged), false},
+		{"bad checksum before more records", join(first, damaged, first), true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "test.db")
+		if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		kv, err := openKVStore(path)
+		if tt.wantErr {
+			if err == nil {
+				kv.Close()
+				t.Errorf("%s: opened a store with a corrupt record", tt.name)
+			}
+			if data, _ := os.ReadFile(path); len(data) != len(tt.data) {
+				t.Errorf("%s: file was truncated to %d bytes", tt.name, len(data))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if v, ok := kv.Get("a"); !ok || string(v) != "1" {
+			t.Errorf("%s: a = %q, %t", tt.name, v, ok)
+		}
+		if _, ok := kv.Get("b"); ok {
+			t.Errorf("%s: replayed the incomplete record", tt.name)
+		}
+		kv.Close()
+		if data, _ := os.ReadFile(path); len(data) != len(first) {
+			t.Errorf("%s: file is %d bytes, want %d", tt.name, len(data), len(first))
+		}
+	}
+}
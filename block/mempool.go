@@ -0,0 +1,274 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// coinbaseSizeReserve ブロックサイズのうちマイニング報酬のトランザクション用に空けておくバイト数です。
+const coinbaseSizeReserve = 512
+
+func transactionSize(t *Transaction) int {
+	m, _ := json.Marshal(t)
+	return len(m)
+}
+
+// transactionsSize ブロックのトランザクションのJSONの合計サイズです。MaxBlockSizeを超えるブロックは無効です。
+func transactionsSize(transactions []*Transaction) int {
+	size := 0
+	for _, t := range transactions {
+		size += transactionSize(t)
+	}
+	return size
+}
+
+// assembleTransactions プールからブロックに入れるトランザクションを選び、先頭にマイニング報酬を付けて返します。
+// 手数料率(手数料/サイズ)の高い順に選びますが、同じ送信者のトランザクションはnonceの順にしか選びません。
+// MaxBlockSizeに収まらなくなった送信者の残りのトランザクションは次のブロックに回します。
+func (bc *Blockchain) assembleTransactions() []*Transaction {
+	// スラッシングは同じ送信者のアンステークより先に適用されるよう、手数料に関係なく先頭に入れます。
+	var selected []*Transaction
+	size := coinbaseSizeReserve
+	var senders []string
+	queues := make(map[string][]*Transaction)
+	for _, t := range bc.transactionPool {
+		if t.IsSlashing() {
+			if size+transactionSize(t) > MaxBlockSize {
+				continue
+			}
+			selected = append(selected, t)
+			size += transactionSize(t)
+			continue
+		}
+		if _, ok := queues[t.SenderBlockchainAddress]; !ok {
+			senders = append(senders, t.SenderBlockchainAddress)
+		}
+		queues[t.SenderBlockchainAddress] = append(queues[t.SenderBlockchainAddress], t)
+	}
+
+	var fees Amount
+	for {
+		best := -1
+		var bestRate float64
+		var bestSize int
+		for i, sender := range senders {
+			queue := queues[sender]
+			if len(queue) == 0 {
+				continue
+			}
+			txSize := transactionSize(queue[0])
+			rate := float64(queue[0].Fee) / float64(txSize)
+			if best < 0 || rate > bestRate {
+				best, bestRate, bestSize = i, rate, txSize
+			}
+		}
+		if best < 0 {
+			break
+		}
+		sender := senders[best]
+		if size+bestSize > MaxBlockSize {
+			queues[sender] = nil
+			continue
+		}
+		t := queues[sender][0]
+		sum, err := SumAmounts(fees, t.Fee)
+		if err != nil {
+			queues[sender] = nil
+			continue
+		}
+		queues[sender] = queues[sender][1:]
+		selected = append(selected, t)
+		fees = sum
+		size += bestSize
+	}
+
+	// 発行量が上限に達して手数料も無い場合、マイニング報酬のトランザクションは作りません。
+	reward := bc.newMiningReward(fees)
+	if reward.Value == 0 {
+		return selected
+	}
+	return append([]*Transaction{reward}, selected...)
+}
+
+// removeFromPool ブロックに含めたトランザクションをプールから取り除きます。
+func (bc *Blockchain) removeFromPool(transactions []*Transaction) {
+	included := make(map[string]bool, len(transactions))
+	for _, t := range transactions {
+		included[t.ID()] = true
+	}
+	pool := make([]*Transaction, 0, len(bc.transactionPool))
+	for _, t := range bc.transactionPool {
+		if !included[t.ID()] {
+			pool = append(pool, t)
+		}
+	}
+	bc.transactionPool = pool
+	bc.indexPool()
+}
+
+// addToPool トランザクションをプールに追加し、送信者の未承認の出金と受取人の未承認の入金に加えます。
+func (bc *Blockchain) addToPool(t *Transaction) {
+	if bc.pendingSpends == nil {
+		bc.indexPool()
+	}
+	bc.transactionPool = append(bc.transactionPool, t)
+	bc.trackPending(t)
+}
+
+// indexPool プールの内容から未承認の出金と入金を数え直します。
+func (bc *Blockchain) indexPool() {
+	bc.pendingSpends = make(map[string]Amount)
+	bc.pendingReceipts = make(map[string]Amount)
+	bc.pendingInputs = make(map[OutPoint]string)
+	for _, t := range bc.transactionPool {
+		bc.trackPending(t)
+	}
+}
+
+// trackPending UTXO方式のトランザクションでは使う出力の合計を出金、全ての出力(お釣りを含む)を入金として数えます。
+// ステークのトランザクションは残高からの出金だけ、アンステークは手数料の出金だけを数えます。
+// アンステークした額はUnbondingBlocks後に残高に戻るので、未承認の入金には含めません。
+func (bc *Blockchain) trackPending(t *Transaction) {
+	switch {
+	case t.IsSlashing():
+		return
+	case t.IsStake():
+		bc.pendingSpends[t.SenderBlockchainAddress] += t.Value + t.Fee
+		return
+	case t.IsUnstake():
+		bc.pendingSpends[t.SenderBlockchainAddress] += t.Fee
+		return
+	}
+	if len(t.Inputs) == 0 {
+		bc.pendingSpends[t.SenderBlockchainAddress] += t.Value + t.Fee
+		bc.pendingReceipts[t.RecipientBlockchainAddress] += t.Value
+		return
+	}
+	id := t.ID()
+	for _, op := range t.Inputs {
+		o, _ := bc.utxos.Get(op)
+		bc.pendingSpends[t.SenderBlockchainAddress] += o.Value
+		bc.pendingInputs[op] = id
+	}
+	for _, o := range t.Outputs {
+		bc.pendingReceipts[o.Address] += o.Value
+	}
+}
+
+// PendingSpend プールにあるaddressからの送金額と手数料の合計です。
+func (bc *Blockchain) PendingSpend(address string) Amount {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.pendingSpends[address]
+}
+
+// PendingReceipt プールにあるaddress宛ての送金額の合計です。
+func (bc *Blockchain) PendingReceipt(address string) Amount {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.pendingReceipts[address]
+}
+
+// AvailableAmount 承認済みの残高からプールにある送金を差し引いた、新しい送金に使える額です。
+// 未承認の入金はまだ使えないので含めません。
+func (bc *Blockchain) AvailableAmount(address string) Amount {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.CalculateTotalAmount(address) - bc.pendingSpends[address]
+}
+
+// canSpend プールにある送金に加えてamountsを支払えるだけの承認済みの残高がaddressにあるか返します。
+// 合計がint64の範囲を超える場合も支払えないものとして扱います。
+func (bc *Blockchain) canSpend(address string, amounts ...Amount) bool {
+	total, err := SumAmounts(append([]Amount{bc.pendingSpends[address]}, amounts...)...)
+	return err == nil && total <= bc.CalculateTotalAmount(address)
+}
+
+// PendingAmount プールのトランザクションが全て承認された場合の残高です。
+func (bc *Blockchain) PendingAmount(address string) Amount {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.CalculateTotalAmount(address) - bc.pendingSpends[address] + bc.pendingReceipts[address]
+}
+
+// pruneTransactionPool 承認済みの状態に対して無効になったトランザクションをプールから取り除きます。
+// 別のチェーンに置き換わった後などに、nonceが合わなくなったものや残高が足りなくなったものが対象です。
+// 同じ送信者のそれ以降のトランザクションもnonceが続かなくなるので一緒に取り除きます。
+func (bc *Blockchain) pruneTransactionPool() {
+	if bc.config.UTXO() {
+		bc.pruneUTXOTransactionPool()
+		return
+	}
+	nonces := make(map[string]uint64)
+	balances := make(map[string]Amount)
+	stakes := make(map[string]Amount)
+	invalid := make(map[string]bool)
+	pool := make([]*Transaction, 0, len(bc.transactionPool))
+	// スラッシングはブロックの先頭に入るので、先に没収したステークで残りのアンステークを確認します。
+	for _, t := range bc.transactionPool {
+		if !t.IsSlashing() {
+			continue
+		}
+		sender := t.SenderBlockchainAddress
+		if bc.state.EvidenceUsed(t.Evidence.ID()) {
+			log.Printf("blockchain: action=drop_transaction, id=%s, slash=%s, status=evidence_used", t.ID(), sender)
+			continue
+		}
+		stakes[sender] = 0
+		pool = append(pool, t)
+	}
+	for _, t := range bc.transactionPool {
+		if t.IsSlashing() {
+			continue
+		}
+		sender := t.SenderBlockchainAddress
+		if _, ok := nonces[sender]; !ok {
+			nonces[sender] = bc.ConfirmedNonce(sender)
+			balances[sender] = bc.CalculateTotalAmount(sender)
+		}
+		if _, ok := stakes[sender]; !ok {
+			stakes[sender] = bc.Stake(sender)
+		}
+		spend, err := SumAmounts(t.Value, t.Fee)
+		unstake := Amount(0)
+		if t.IsUnstake() {
+			spend, unstake = t.Fee, t.Value
+		}
+		if err != nil || invalid[sender] || t.Nonce != nonces[sender] || balances[sender] < spend || stakes[sender] < unstake {
+			invalid[sender] = true
+			log.Printf("blockchain: action=drop_transaction, id=%s, nonce=%d, expected=%d", t.ID(), t.Nonce, nonces[sender])
+			continue
+		}
+		nonces[sender]++
+		balances[sender] -= spend
+		stakes[sender] -= unstake
+		pool = append(pool, t)
+	}
+	bc.transactionPool = pool
+	bc.indexPool()
+}
+
+// pruneUTXOTransactionPool 入力が既に使われた、またはプール内で二重に使われているトランザクションを取り除きます。
+func (bc *Blockchain) pruneUTXOTransactionPool() {
+	used := make(map[OutPoint]bool)
+	pool := make([]*Transaction, 0, len(bc.transactionPool))
+	for _, t := range bc.transactionPool {
+		_, err := bc.utxos.checkTransaction(t)
+		for _, op := range t.Inputs {
+			if err == nil && used[op] {
+				err = fmt.Errorf("input %s is spent by another transaction", op)
+			}
+		}
+		if err != nil {
+			log.Printf("blockchain: action=drop_transaction, id=%s, error=%v", t.ID(), err)
+			continue
+		}
+		for _, op := range t.Inputs {
+			used[op] = true
+		}
+		pool = append(pool, t)
+	}
+	bc.transactionPool = pool
+	bc.indexPool()
+}
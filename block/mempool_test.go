@@ -0,0 +1,147 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"testing"
+)
+
+// newTestKey テスト用の鍵とそのアドレスを返します。
+func newTestKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, utils.AddressFromPublicKey(&key.PublicKey)
+}
+
+// signedTransfer keyで署名した送金のトランザクションを作成します。
+func signedTransfer(t *testing.T, key *ecdsa.PrivateKey, recipient string, value, fee Amount, nonce uint64) *Transaction {
+	t.Helper()
+	tx := NewSignedTransaction(utils.AddressFromPublicKey(&key.PublicKey), recipient, value, fee, nonce, &key.PublicKey, nil)
+	h := tx.SigningHash()
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Signature = &utils.Signature{R: r, S: s}
+	return tx
+}
+
+// newTestBlockchain 難易度を下げたメモリ上のチェーンを作り、minerに最初のブロックの報酬を支払います。
+func newTestBlockchain(t *testing.T, miner string) *Blockchain {
+	t.Helper()
+	config := DefaultChainConfig()
+	config.InitialDifficulty = MinDifficulty
+	bc, err := NewBlockchainWithStore(miner, 0, NewMemoryBlockStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.SetMiningWorkers(1)
+	if !bc.Mining() {
+		t.Fatal("could not mine the first block")
+	}
+	return bc
+}
+
+func TestAddSignedTransactionLimits(t *testing.T) {
+	key, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+
+	overflow := signedTransfer(t, key, "bob", 5000000000000000000, 5000000000000000000, 0)
+	if bc.AddSignedTransaction(overflow) {
+		t.Fatal("accepted a transfer whose value plus fee overflows")
+	}
+	if !bc.AddSignedTransaction(signedTransfer(t, key, "bob", Coin/2, Coin/4, 0)) {
+		t.Fatal("rejected a valid transfer")
+	}
+	if bc.AddSignedTransaction(signedTransfer(t, key, "bob", Coin/2, 0, 1)) {
+		t.Fatal("accepted a transfer that spends more than the available balance")
+	}
+	if got, want := bc.AvailableAmount(alice), Coin/4; got != want {
+		t.Errorf("AvailableAmount = %s, want %s", got, want)
+	}
+	if got := bc.NextNonce(alice); got != 1 {
+		t.Errorf("NextNonce = %d, want 1", got)
+	}
+}
+
+// TestMempoolConcurrentAccess go test -raceで、プールへの追加とマイニングが同時に起きても競合しないことを確認します。
+func TestMempoolConcurrentAccess(t *testing.T) {
+	key, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			bc.Mining()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			nonce := bc.NextNonce(alice)
+			bc.AddSignedTransaction(signedTransfer(t, key, "bob", 1, 0, nonce))
+			bc.AvailableAmount(alice)
+			bc.PendingAmount("bob")
+			bc.FindTransaction("missing")
+			bc.TransactionPool()
+		}
+	}()
+	wg.Wait()
+	if err := bc.CheckBalanceIndex(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingEngine releaseが閉じられるまでSealを止める合意の方式です。
+type blockingEngine struct {
+	Consensus
+	sealing chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingEngine) Seal(bc *Blockchain, tmpl *BlockTemplate) (*Block, error) {
+	close(e.sealing)
+	<-e.release
+	return e.Consensus.Seal(bc, tmpl)
+}
+
+// TestAddTransactionWhileMining 封印の途中でもトランザクションを追加でき、封印の後もプールに残ることを確認します。
+func TestAddTransactionWhileMining(t *testing.T) {
+	key, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+	engine := &blockingEngine{Consensus: bc.engine, sealing: make(chan struct{}), release: make(chan struct{})}
+	bc.engine = engine
+
+	done := make(chan bool)
+	go func() {
+		done <- bc.Mining()
+	}()
+	<-engine.sealing
+	tx := signedTransfer(t, key, "bob", Coin/2, 0, 0)
+	if !bc.AddSignedTransaction(tx) {
+		t.Fatal("transaction was rejected while a block was being sealed")
+	}
+	close(engine.release)
+	if !<-done {
+		t.Fatal("mining failed")
+	}
+	status, err := bc.FindTransaction(tx.ID())
+	if err != nil || status.Status != TransactionPending {
+		t.Fatalf("transaction after mining: %v, %v", status, err)
+	}
+	bc.engine = engine.Consensus
+	if !bc.Mining() {
+		t.Fatal("mining failed")
+	}
+	if status, err := bc.FindTransaction(tx.ID()); err != nil || status.Status != TransactionMined {
+		t.Fatalf("transaction was not mined in the next block: %v, %v", status, err)
+	}
+}
@@ -0,0 +1,200 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// merkleNodePrefix 内部ノードのハッシュに付けるプレフィックスです。葉(トランザクションハッシュ)と区別するために使います。
+const merkleNodePrefix = 0x01
+
+func merkleParent(left, right [32]byte) [32]byte {
+	buf := make([]byte, 0, 1+32+32)
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// merkleLevels 葉から根までの各段のハッシュを返します。奇数個の段では最後のノードをそのまま上の段に上げます。
+func merkleLevels(leaves [][32]byte) [][][32]byte {
+	levels := [][][32]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][32]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleParent(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// MerkleRoot ハッシュのリストからマークルルートを計算します。空の場合はゼロのハッシュを返します。
+func MerkleRoot(hashes [][32]byte) [32]byte {
+	if len(hashes) == 0 {
+		return [32]byte{}
+	}
+	levels := merkleLevels(hashes)
+	return levels[len(levels)-1][0]
+}
+
+func transactionHashes(transactions []*Transaction) [][32]byte {
+	hashes := make([][32]byte, 0, len(transactions))
+	for _, t := range transactions {
+		hashes = append(hashes, t.Hash())
+	}
+	return hashes
+}
+
+// TransactionsMerkleRoot トランザクションのハッシュからマークルルートを計算します。
+func TransactionsMerkleRoot(transactions []*Transaction) [32]byte {
+	return MerkleRoot(transactionHashes(transactions))
+}
+
+// MerkleStep マークルプルーフの1段分です。Leftがtrueの場合、兄弟ノードは左側にあります。
+type MerkleStep struct {
+	Hash [32]byte
+	Left bool
+}
+
+func (ms *MerkleStep) MarshalJSON() ([]byte, error) {
+	position := "right"
+	if ms.Left {
+		position = "left"
+	}
+	return json.Marshal(struct {
+		Hash     string `json:"hash"`
+		Position string `json:"position"`
+	}{
+		Hash:     fmt.Sprintf("%x", ms.Hash),
+		Position: position,
+	})
+}
+
+func (ms *MerkleStep) UnmarshalJSON(data []byte) error {
+	var hash, position string
+	v := &struct {
+		Hash     *string `json:"hash"`
+		Position *string `json:"position"`
+	}{
+		Hash:     &hash,
+		Position: &position,
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	ms.Left = position == "left"
+	return decodeHash(hash, &ms.Hash)
+}
+
+// MerkleBranch index番目の葉からマークルルートまでの兄弟ノードを返します。
+func MerkleBranch(hashes [][32]byte, index int) []*MerkleStep {
+	if index < 0 || index >= len(hashes) {
+		return nil
+	}
+	levels := merkleLevels(hashes)
+	branch := make([]*MerkleStep, 0, len(levels))
+	for _, level := range levels[:len(levels)-1] {
+		if index%2 == 1 {
+			branch = append(branch, &MerkleStep{Hash: level[index-1], Left: true})
+		} else if index+1 < len(level) {
+			branch = append(branch, &MerkleStep{Hash: level[index+1], Left: false})
+		}
+		index /= 2
+	}
+	return branch
+}
+
+// VerifyMerkleBranch 葉のハッシュとbranchからルートを計算し、rootと一致するか確認します。
+func VerifyMerkleBranch(leaf [32]byte, branch []*MerkleStep, root [32]byte) bool {
+	h := leaf
+	for _, step := range branch {
+		if step.Left {
+			h = merkleParent(step.Hash, h)
+		} else {
+			h = merkleParent(h, step.Hash)
+		}
+	}
+	return h == root
+}
+
+// TransactionProof トランザクションがブロックに含まれていることの証明(SPVプルーフ)です。
+// 検証する側が内容を確かめられるよう、トランザクションそのものも含めます。
+type TransactionProof struct {
+	TxID        string
+	TxHash      [32]byte
+	Transaction *Transaction
+	BlockHash   [32]byte
+	Height      int
+	Header      *BlockHeader
+	Branch      []*MerkleStep
+}
+
+// VerifyTransactionProof proofが信頼できるheaderに対して正しいか確認します。
+// proofのトランザクションのハッシュとIDがTxHashとTxIDに一致しない場合も失敗します。
+func VerifyTransactionProof(proof *TransactionProof, header *BlockHeader) bool {
+	if proof == nil || header == nil || proof.Transaction == nil {
+		return false
+	}
+	if proof.Transaction.Hash() != proof.TxHash || proof.Transaction.ID() != proof.TxID {
+		return false
+	}
+	if proof.BlockHash != header.Hash() {
+		return false
+	}
+	return VerifyMerkleBranch(proof.TxHash, proof.Branch, header.MerkleRoot)
+}
+
+func (tp *TransactionProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID        string        `json:"tx_id"`
+		TxHash      string        `json:"tx_hash"`
+		Transaction *Transaction  `json:"transaction"`
+		BlockHash   string        `json:"block_hash"`
+		Height      int           `json:"height"`
+		Header      *BlockHeader  `json:"header"`
+		Branch      []*MerkleStep `json:"branch"`
+	}{
+		TxID:        tp.TxID,
+		TxHash:      fmt.Sprintf("%x", tp.TxHash),
+		Transaction: tp.Transaction,
+		BlockHash:   fmt.Sprintf("%x", tp.BlockHash),
+		Height:      tp.Height,
+		Header:      tp.Header,
+		Branch:      tp.Branch,
+	})
+}
+
+func (tp *TransactionProof) UnmarshalJSON(data []byte) error {
+	var txHash, blockHash string
+	v := &struct {
+		TxID        *string        `json:"tx_id"`
+		TxHash      *string        `json:"tx_hash"`
+		Transaction **Transaction  `json:"transaction"`
+		BlockHash   *string        `json:"block_hash"`
+		Height      *int           `json:"height"`
+		Header      **BlockHeader  `json:"header"`
+		Branch      *[]*MerkleStep `json:"branch"`
+	}{
+		TxID:        &tp.TxID,
+		TxHash:      &txHash,
+		Transaction: &tp.Transaction,
+		BlockHash:   &blockHash,
+		Height:      &tp.Height,
+		Header:      &tp.Header,
+		Branch:      &tp.Branch,
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if err := decodeHash(txHash, &tp.TxHash); err != nil {
+		return err
+	}
+	return decodeHash(blockHash, &tp.BlockHash)
+}
@@ -0,0 +1,77 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+)
+
+func TestMerkleBranch(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		hashes := make([][32]byte, n)
+		for i := range hashes {
+			hashes[i] = [32]byte{byte(i + 1)}
+		}
+		root := MerkleRoot(hashes)
+		for i := range hashes {
+			branch := MerkleBranch(hashes, i)
+			if !VerifyMerkleBranch(hashes[i], branch, root) {
+				t.Errorf("%d leaves: branch of leaf %d does not verify", n, i)
+			}
+			if VerifyMerkleBranch([32]byte{0xff}, branch, root) {
+				t.Errorf("%d leaves: branch of leaf %d verifies another leaf", n, i)
+			}
+		}
+	}
+	if MerkleBranch([][32]byte{{1}}, 1) != nil {
+		t.Error("branch for an index out of range")
+	}
+	// 内部ノードはプレフィックスで葉と区別されるので、2つの葉をつなげたハッシュは根になりません
+	left, right := [32]byte{1}, [32]byte{2}
+	if VerifyMerkleBranch(sha256.Sum256(append(left[:], right[:]...)), nil, MerkleRoot([][32]byte{left, right})) {
+		t.Error("the concatenated leaves verified as the root")
+	}
+}
+
+func TestVerifyTransactionProof(t *testing.T) {
+	_, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+	last := bc.LastBlock()
+	tx := last.Transactions[0]
+
+	proof, err := bc.TransactionProof(tx.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TransactionProof
+	if err := json.Unmarshal(m, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	header := last.Header()
+	if !VerifyTransactionProof(&decoded, header) {
+		t.Fatal("proof does not verify after a JSON round trip")
+	}
+
+	other := NewTransaction(MiningSender, "mallory", tx.Value)
+	tests := []struct {
+		name   string
+		tamper func(p *TransactionProof)
+	}{
+		{"no transaction", func(p *TransactionProof) { p.Transaction = nil }},
+		{"another transaction", func(p *TransactionProof) { p.Transaction = other }},
+		{"another id", func(p *TransactionProof) { p.TxID = other.ID() }},
+		{"another hash", func(p *TransactionProof) { p.TxHash = other.Hash() }},
+		{"another block", func(p *TransactionProof) { p.BlockHash = [32]byte{1} }},
+	}
+	for _, tt := range tests {
+		p := *proof
+		tt.tamper(&p)
+		if VerifyTransactionProof(&p, header) {
+			t.Errorf("%s: tampered proof verified", tt.name)
+		}
+	}
+}
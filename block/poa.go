@@ -0,0 +1,175 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	ConsensusPoA = "poa" // プルーフオブオーソリティ
+
+	DefaultBlockPeriodSec = 5 // PoAとPoSでBlockPeriodSecが0の場合のブロックの間隔
+)
+
+// genesisTimestamp 署名でブロックを封印する合意の方式のジェネシスブロックのタイムスタンプです。
+// 同じチェーン設定で起動した全てのノードが、同じジェネシスブロックを作るように固定します。
+const genesisTimestamp = 0
+
+// RuleSigner ブロックの署名者に関するルールです。
+const RuleSigner = "signer"
+
+var (
+	ErrNoSigner      = errors.New("no signer key is set")
+	ErrNotInTurn     = errors.New("not this signer's turn")
+	ErrTooEarly      = errors.New("block period has not elapsed")
+	errNoAuthorities = errors.New("poa: no authorities configured")
+)
+
+// ProofOfAuthority 設定したアドレス(オーソリティ)が高さの順に交代でブロックを作る合意の方式です。
+// 高さheightのブロックはAuthorities[height%len(Authorities)]が作り、その鍵でヘッダーに署名します。
+// ブロックの間隔はBlockPeriodSec以上で、フォーク選択は長さ(ブロック1つの重みが1)で行います。
+type ProofOfAuthority struct {
+	config *ChainConfig
+}
+
+func newProofOfAuthority(config *ChainConfig) (Consensus, error) {
+	if config == nil || len(config.Authorities) == 0 {
+		return nil, errNoAuthorities
+	}
+	return &ProofOfAuthority{config: config}, nil
+}
+
+func init() {
+	RegisterConsensus(ConsensusPoA, newProofOfAuthority)
+}
+
+func (poa *ProofOfAuthority) Name() string {
+	return ConsensusPoA
+}
+
+func (poa *ProofOfAuthority) period() time.Duration {
+	return blockPeriod(poa.config)
+}
+
+// blockPeriod 署名でブロックを封印する合意の方式でのブロックの間隔です。
+func blockPeriod(config *ChainConfig) time.Duration {
+	if config.BlockPeriodSec <= 0 {
+		return DefaultBlockPeriodSec * time.Second
+	}
+	return time.Duration(config.BlockPeriodSec) * time.Second
+}
+
+// signHeader keyの公開鍵をヘッダーの署名者にして、SealHashに署名します。
+func signHeader(key *ecdsa.PrivateKey, header *BlockHeader) error {
+	header.Signer = &key.PublicKey
+	header.Signature = nil
+	h := header.SealHash()
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		return err
+	}
+	header.Signature = &utils.Signature{R: r, S: s}
+	return nil
+}
+
+// verifyHeaderSignature ヘッダーの署名を検証し、署名者のアドレスを返します。
+func verifyHeaderSignature(header *BlockHeader) (string, bool) {
+	if header.Signer == nil || header.Signature == nil || header.Signature.R == nil || header.Signature.S == nil {
+		return "", false
+	}
+	h := header.SealHash()
+	if !ecdsa.Verify(header.Signer, h[:], header.Signature.R, header.Signature.S) {
+		return "", false
+	}
+	return utils.AddressFromPublicKey(header.Signer), true
+}
+
+// Authority 高さheightのブロックを作るアドレスです。
+func (poa *ProofOfAuthority) Authority(height int) string {
+	return poa.config.Authorities[height%len(poa.config.Authorities)]
+}
+
+func (poa *ProofOfAuthority) Prepare(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	header.Difficulty = 0
+	if height == 0 {
+		header.Timestamp = genesisTimestamp
+		return nil
+	}
+	earliest := blockAt(height-1).Timestamp + int64(poa.period())
+	if header.Timestamp < earliest {
+		return ErrTooEarly
+	}
+	return nil
+}
+
+// Seal 自ノードの鍵がこの高さのオーソリティであれば、ヘッダーに署名してブロックにします。
+func (poa *ProofOfAuthority) Seal(bc *Blockchain, tmpl *BlockTemplate) (*Block, error) {
+	key := bc.Signer()
+	if key == nil {
+		return nil, ErrNoSigner
+	}
+	if utils.AddressFromPublicKey(&key.PublicKey) != poa.Authority(tmpl.Height) {
+		return nil, ErrNotInTurn
+	}
+	sealed := *tmpl
+	if err := signHeader(key, &sealed.Header); err != nil {
+		return nil, err
+	}
+	return sealed.Block(0), nil
+}
+
+func (poa *ProofOfAuthority) VerifyHeader(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	if header.Difficulty != 0 || header.Nonce != 0 {
+		return blockError(height, RuleDifficulty, "poa blocks must have zero difficulty and nonce")
+	}
+	if height == 0 {
+		if header.Signer != nil || header.Signature != nil {
+			return blockError(height, RuleGenesis, "genesis block must not be signed")
+		}
+		return nil
+	}
+	if earliest := blockAt(height-1).Timestamp + int64(poa.period()); header.Timestamp < earliest {
+		return blockError(height, RuleTimestamp, "timestamp %d is before the block period ends at %d", header.Timestamp, earliest)
+	}
+	signer, ok := verifyHeaderSignature(header)
+	if !ok {
+		return blockError(height, RuleSigner, "missing or invalid block signature")
+	}
+	if expected := poa.Authority(height); signer != expected {
+		return blockError(height, RuleSigner, "signed by %s, expected %s", signer, expected)
+	}
+	return nil
+}
+
+// VerifySeal ヘッダーがいずれかのオーソリティの正しい署名を持つか確認します。高さが分からないので順番は確認しません。
+func (poa *ProofOfAuthority) VerifySeal(header *BlockHeader) error {
+	signer, ok := verifyHeaderSignature(header)
+	if !ok {
+		return errors.New("missing or invalid block signature")
+	}
+	for _, authority := range poa.config.Authorities {
+		if signer == authority {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an authority", signer)
+}
+
+func (poa *ProofOfAuthority) Weight(header *BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// NextBlockTime 自ノードが次のブロックのオーソリティであれば、ブロックを作れる時刻を返します。
+func (poa *ProofOfAuthority) NextBlockTime(bc *Blockchain) (time.Time, bool) {
+	key := bc.Signer()
+	height := bc.chain.Height()
+	if key == nil || utils.AddressFromPublicKey(&key.PublicKey) != poa.Authority(height) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, bc.LastBlock().Timestamp).Add(poa.period()), true
+}
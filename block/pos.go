@@ -0,0 +1,234 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const ConsensusPoS = "pos" // プルーフオブステーク
+
+// maxSchedulerRounds NextBlockTimeで自ノードの番を探す先のラウンド数です。
+const maxSchedulerRounds = 64
+
+// maxClockDrift 受け取ったブロックのタイムスタンプが自ノードの現在時刻より先でも許す時間です。
+// ラウンドはタイムスタンプで決まるので、これより先のラウンドを選んでプロポーザーになるブロックは受け付けません。
+const maxClockDrift = 2 * time.Second
+
+var (
+	errPoSLedger = errors.New("pos: staking requires an account ledger")
+	errNoStakes  = errors.New("pos: no genesis stake configured")
+)
+
+// ProofOfStake ステークに比例した確率で選ばれたプロポーザーがブロックに署名する合意の方式です。
+// 高さheightのプロポーザーは、親ブロックまでのステークと親ブロックのハッシュをシードにして選びます。
+// 親からBlockPeriodSecごとにラウンドが進み、選ばれたプロポーザーがブロックを作らない場合は次のラウンドで選び直します。
+// マイニング報酬はプロポーザーに支払われ、同じ親に続く2つのブロックに署名したプロポーザーはステークを没収されます。
+type ProofOfStake struct {
+	config *ChainConfig
+
+	mux      sync.Mutex
+	snapshot *stakeSnapshot
+}
+
+// stakeSnapshot あるブロックまでを適用した状態です。続くブロックを検証するときに最初から再生しないよう取っておきます。
+type stakeSnapshot struct {
+	height int
+	hash   [32]byte
+	state  *accountState
+}
+
+func newProofOfStake(config *ChainConfig) (Consensus, error) {
+	if config.UTXO() {
+		return nil, errPoSLedger
+	}
+	if len(config.GenesisStake) == 0 {
+		return nil, errNoStakes
+	}
+	return &ProofOfStake{config: config}, nil
+}
+
+func init() {
+	RegisterConsensus(ConsensusPoS, newProofOfStake)
+}
+
+func (pos *ProofOfStake) Name() string {
+	return ConsensusPoS
+}
+
+// stakesAt 高さheightのブロックまでを適用したステークを返します。
+func (pos *ProofOfStake) stakesAt(blockAt BlockAtFunc, height int) map[string]Amount {
+	pos.mux.Lock()
+	defer pos.mux.Unlock()
+	target := blockAt(height)
+	hash := target.Hash()
+	snap := pos.snapshot
+	switch {
+	case snap != nil && snap.height == height && snap.hash == hash:
+	case snap != nil && snap.height == height-1 && snap.hash == target.PreviousHash:
+		snap.state.applyBlock(target)
+		snap.height, snap.hash = height, hash
+	default:
+		state := newAccountState()
+		for h := 0; h <= height; h++ {
+			state.applyBlock(blockAt(h))
+		}
+		snap = &stakeSnapshot{height: height, hash: hash, state: state}
+		pos.snapshot = snap
+	}
+	return snap.state.Stakes()
+}
+
+// round タイムスタンプtimestampのブロックが親から何番目のラウンドかを返します。
+func (pos *ProofOfStake) round(parent *Block, timestamp int64) uint64 {
+	return uint64((timestamp-parent.Timestamp)/int64(blockPeriod(pos.config))) - 1
+}
+
+// Proposer ステークstakesの中から、親parentHashに続くブロックのroundラウンド目のプロポーザーを選びます。
+// シード(親のハッシュとラウンドのハッシュ)をステークの合計で割った余りが、アドレス順に積み上げたステークのどこに入るかで決めます。
+func Proposer(stakes map[string]Amount, parentHash [32]byte, round uint64) (string, bool) {
+	infos := sortedStakes(stakes)
+	var total Amount
+	for _, si := range infos {
+		total += si.Stake
+	}
+	if total <= 0 {
+		return "", false
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], round)
+	seed := sha256.Sum256(append(parentHash[:], buf[:]...))
+	r := new(big.Int).Mod(new(big.Int).SetBytes(seed[:]), big.NewInt(int64(total))).Int64()
+	for _, si := range infos {
+		if r < int64(si.Stake) {
+			return si.Address, true
+		}
+		r -= int64(si.Stake)
+	}
+	return "", false
+}
+
+// proposer 高さheightのブロックのroundラウンド目のプロポーザーです。
+func (pos *ProofOfStake) proposer(blockAt BlockAtFunc, height int, round uint64) (string, bool) {
+	return Proposer(pos.stakesAt(blockAt, height-1), blockAt(height-1).Hash(), round)
+}
+
+func (pos *ProofOfStake) Prepare(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	header.Difficulty = 0
+	if height == 0 {
+		header.Timestamp = genesisTimestamp
+		return nil
+	}
+	earliest := blockAt(height-1).Timestamp + int64(blockPeriod(pos.config))
+	if header.Timestamp < earliest {
+		return ErrTooEarly
+	}
+	return nil
+}
+
+// Seal 自ノードの鍵がこのラウンドのプロポーザーであれば、ヘッダーに署名してブロックにします。
+func (pos *ProofOfStake) Seal(bc *Blockchain, tmpl *BlockTemplate) (*Block, error) {
+	key := bc.Signer()
+	if key == nil {
+		return nil, ErrNoSigner
+	}
+	round := pos.round(bc.storedBlockAt(tmpl.Height-1), tmpl.Header.Timestamp)
+	proposer, _ := pos.proposer(bc.storedBlockAt, tmpl.Height, round)
+	if utils.AddressFromPublicKey(&key.PublicKey) != proposer {
+		return nil, ErrNotInTurn
+	}
+	sealed := *tmpl
+	if err := signHeader(key, &sealed.Header); err != nil {
+		return nil, err
+	}
+	return sealed.Block(0), nil
+}
+
+func (pos *ProofOfStake) VerifyHeader(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	if header.Difficulty != 0 || header.Nonce != 0 {
+		return blockError(height, RuleDifficulty, "pos blocks must have zero difficulty and nonce")
+	}
+	if height == 0 {
+		if header.Signer != nil || header.Signature != nil {
+			return blockError(height, RuleGenesis, "genesis block must not be signed")
+		}
+		return nil
+	}
+	parent := blockAt(height - 1)
+	if earliest := parent.Timestamp + int64(blockPeriod(pos.config)); header.Timestamp < earliest {
+		return blockError(height, RuleTimestamp, "timestamp %d is before the block period ends at %d", header.Timestamp, earliest)
+	}
+	if latest := time.Now().Add(maxClockDrift).UnixNano(); header.Timestamp > latest {
+		return blockError(height, RuleTimestamp, "timestamp %d is in a future round", header.Timestamp)
+	}
+	signer, ok := verifyHeaderSignature(header)
+	if !ok {
+		return blockError(height, RuleSigner, "missing or invalid block signature")
+	}
+	round := pos.round(parent, header.Timestamp)
+	expected, ok := pos.proposer(blockAt, height, round)
+	if !ok {
+		return blockError(height, RuleStake, "no address has stake to propose a block")
+	}
+	if signer != expected {
+		return blockError(height, RuleSigner, "signed by %s, expected proposer %s for round %d", signer, expected, round)
+	}
+	return nil
+}
+
+// VerifyBlock マイニング報酬がブロックに署名したプロポーザーに支払われているか確認します。
+func (pos *ProofOfStake) VerifyBlock(height int, b *Block) error {
+	if height == 0 {
+		return nil
+	}
+	proposer := utils.AddressFromPublicKey(b.Signer)
+	for i, t := range b.Transactions {
+		if t.SenderBlockchainAddress == MiningSender && t.RecipientBlockchainAddress != proposer {
+			return transactionError(height, i, RuleReward, "reward is paid to %s, not the proposer %s", t.RecipientBlockchainAddress, proposer)
+		}
+	}
+	return nil
+}
+
+// VerifySeal ヘッダーが正しい署名を持ち、タイムスタンプが先のラウンドでないか確認します。ステークは親がないと分かりません。
+func (pos *ProofOfStake) VerifySeal(header *BlockHeader) error {
+	if _, ok := verifyHeaderSignature(header); !ok {
+		return errors.New("missing or invalid block signature")
+	}
+	if header.Timestamp > time.Now().Add(maxClockDrift).UnixNano() {
+		return fmt.Errorf("timestamp %d is in a future round", header.Timestamp)
+	}
+	return nil
+}
+
+func (pos *ProofOfStake) Weight(header *BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// NextBlockTime 今のラウンドから順に、自ノードがプロポーザーになる最初のラウンドの開始時刻を返します。
+func (pos *ProofOfStake) NextBlockTime(bc *Blockchain) (time.Time, bool) {
+	key := bc.Signer()
+	if key == nil {
+		return time.Time{}, false
+	}
+	address := utils.AddressFromPublicKey(&key.PublicKey)
+	height := bc.chain.Height()
+	parent := bc.storedBlockAt(height - 1)
+	period := blockPeriod(pos.config)
+	start := time.Unix(0, parent.Timestamp).Add(period)
+	var round uint64
+	if now := time.Now(); now.After(start) {
+		round = uint64(now.Sub(start) / period)
+	}
+	for r := round; r < round+maxSchedulerRounds; r++ {
+		if proposer, ok := pos.proposer(bc.storedBlockAt, height, r); ok && proposer == address {
+			return start.Add(time.Duration(r) * period), true
+		}
+	}
+	return time.Time{}, false
+}
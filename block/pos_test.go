@@ -0,0 +1,41 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoSRejectsFutureRounds(t *testing.T) {
+	key, alice := newTestKey(t)
+	config := DefaultChainConfig()
+	config.Consensus = ConsensusPoS
+	config.BlockPeriodSec = 1
+	config.GenesisStake = map[string]Amount{alice: 10 * Coin}
+	bc, err := NewBlockchainWithStore(alice, 0, NewMemoryBlockStore(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := bc.storedBlockAt(0)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		ok        bool
+	}{
+		{"now", time.Now(), true},
+		{"within the clock drift", time.Now().Add(maxClockDrift / 2), true},
+		{"future round", time.Now().Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		header := &BlockHeader{PreviousHash: parent.Hash(), Timestamp: tt.timestamp.UnixNano()}
+		if err := signHeader(key, header); err != nil {
+			t.Fatal(err)
+		}
+		err := bc.engine.VerifyHeader(bc.storedBlockAt, 1, header)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if cve, ok := err.(*ChainValidationError); !tt.ok && (!ok || cve.Rule != RuleTimestamp) {
+			t.Errorf("%s: got %v, want rule %s", tt.name, err, RuleTimestamp)
+		}
+	}
+}
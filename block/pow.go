@@ -0,0 +1,230 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProofOfWork ブロックハッシュの先頭ゼロビット数で難易度を表すプルーフオブワークです。
+// 難易度はChainConfigのRetargetIntervalごとに調整し、フォーク選択は累積計算量(2^難易度の合計)で行います。
+type ProofOfWork struct {
+	config *ChainConfig
+}
+
+func newProofOfWork(config *ChainConfig) (Consensus, error) {
+	return &ProofOfWork{config: config}, nil
+}
+
+func (pow *ProofOfWork) Name() string {
+	return ConsensusPoW
+}
+
+// NextDifficulty 高さheightのブロックに要求される難易度を返します。
+func (pow *ProofOfWork) NextDifficulty(blockAt BlockAtFunc, height int) int {
+	return nextDifficulty(pow.config, height, blockAt)
+}
+
+// ValidProof ヘッダーのハッシュ(つまりブロックハッシュ)がヘッダーの難易度を満たすか確認します。
+// タイムスタンプを含むヘッダー全体が対象なので、証明とブロックの内容が食い違うことはありません。
+func (pow *ProofOfWork) ValidProof(header *BlockHeader) bool {
+	return hasLeadingZeroBits(header.Hash(), header.Difficulty)
+}
+
+func (pow *ProofOfWork) Prepare(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	header.Difficulty = pow.NextDifficulty(blockAt, height)
+	return nil
+}
+
+// Seal 複数のワーカーでnonceを探します。探索中にチェーンの先頭が変わった場合はErrSealAbortedを返します。
+func (pow *ProofOfWork) Seal(bc *Blockchain, tmpl *BlockTemplate) (*Block, error) {
+	nonce, ok := bc.searchProof(tmpl.Header, tmpl.epoch)
+	if !ok {
+		return nil, ErrSealAborted
+	}
+	return tmpl.Block(nonce), nil
+}
+
+func (pow *ProofOfWork) VerifyHeader(blockAt BlockAtFunc, height int, header *BlockHeader) error {
+	if expected := pow.NextDifficulty(blockAt, height); header.Difficulty != expected {
+		return blockError(height, RuleDifficulty, "difficulty %d, expected %d", header.Difficulty, expected)
+	}
+	if height > 0 && !pow.ValidProof(header) {
+		return blockError(height, RuleProofOfWork, "hash does not meet difficulty %d", header.Difficulty)
+	}
+	return nil
+}
+
+// VerifySeal 親がなくても確認できるよう、ヘッダーの難易度が下限以上で、ハッシュがその難易度を満たしているかだけを確認します。
+func (pow *ProofOfWork) VerifySeal(header *BlockHeader) error {
+	if header.Difficulty < MinDifficulty {
+		return fmt.Errorf("difficulty %d is below the minimum %d", header.Difficulty, MinDifficulty)
+	}
+	if !pow.ValidProof(header) {
+		return fmt.Errorf("hash does not meet difficulty %d", header.Difficulty)
+	}
+	return nil
+}
+
+// Weight 難易度difficultyのブロック1つ分の期待計算量(2^difficulty)です。
+func (pow *ProofOfWork) Weight(header *BlockHeader) *big.Int {
+	return BlockWork(header.Difficulty)
+}
+
+// powBatchSize ワーカーが一度に受け持つnonceの範囲の大きさです。範囲ごとに中断するか確認します。
+const powBatchSize = 1024
+
+// powMiner プルーフオブワークのワーカー数と、マイニング中の状態です。
+// epochはチェーンの先頭が変わるたびに増え、探索中にepochが変わると探索を中断します。
+type powMiner struct {
+	epoch uint64 // atomic
+
+	mux        sync.Mutex
+	workers    int
+	active     int
+	difficulty int
+	started    time.Time
+	hashes     uint64 // atomic。現在の探索で計算したハッシュの数
+	hashRate   float64
+}
+
+// MiningStatus マイニングの状態です。HashRateは探索中なら現在の探索、そうでなければ直前の探索の1秒あたりのハッシュ数です。
+type MiningStatus struct {
+	Mining     bool
+	Workers    int
+	Height     int
+	Difficulty int
+	Hashes     uint64
+	HashRate   float64
+}
+
+func (ms *MiningStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Mining     bool    `json:"mining"`
+		Workers    int     `json:"workers"`
+		Height     int     `json:"height"`
+		Difficulty int     `json:"difficulty"`
+		Hashes     uint64  `json:"hashes"`
+		HashRate   float64 `json:"hash_rate"`
+	}{
+		Mining:     ms.Mining,
+		Workers:    ms.Workers,
+		Height:     ms.Height,
+		Difficulty: ms.Difficulty,
+		Hashes:     ms.Hashes,
+		HashRate:   ms.HashRate,
+	})
+}
+
+// SetMiningWorkers プルーフオブワークのゴルーチンの数を設定します。0以下の場合はCPUの数です。
+func (bc *Blockchain) SetMiningWorkers(workers int) {
+	bc.pow.mux.Lock()
+	defer bc.pow.mux.Unlock()
+	bc.pow.workers = workers
+}
+
+func (bc *Blockchain) MiningWorkers() int {
+	bc.pow.mux.Lock()
+	defer bc.pow.mux.Unlock()
+	if bc.pow.workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return bc.pow.workers
+}
+
+func (bc *Blockchain) MiningStatus() *MiningStatus {
+	workers := bc.MiningWorkers()
+	bc.pow.mux.Lock()
+	defer bc.pow.mux.Unlock()
+	status := &MiningStatus{
+		Mining:     bc.pow.active > 0,
+		Workers:    workers,
+		Height:     bc.chain.Height(),
+		Difficulty: bc.pow.difficulty,
+		Hashes:     atomic.LoadUint64(&bc.pow.hashes),
+		HashRate:   bc.pow.hashRate,
+	}
+	if status.Mining {
+		if elapsed := time.Since(bc.pow.started).Seconds(); elapsed > 0 {
+			status.HashRate = float64(status.Hashes) / elapsed
+		}
+	}
+	return status
+}
+
+// tipEpoch チェーンの先頭が変わった回数です。
+func (bc *Blockchain) tipEpoch() uint64 {
+	return atomic.LoadUint64(&bc.pow.epoch)
+}
+
+// tipChanged 探索中のプルーフオブワークを中断させます。チェーンの先頭を変えたときに呼びます。
+func (bc *Blockchain) tipChanged() {
+	atomic.AddUint64(&bc.pow.epoch, 1)
+}
+
+// searchProof ヘッダーのハッシュが難易度を満たすnonceを複数のワーカーで探します。
+// 各ワーカーは共有のカウンタからpowBatchSizeずつnonceの範囲を受け取って調べます。
+// 探索中にチェーンの先頭が変わる(tipEpochがepochでなくなる)と中断し、falseを返します。
+func (bc *Blockchain) searchProof(guess BlockHeader, epoch uint64) (int, bool) {
+	difficulty := guess.Difficulty
+	workers := bc.MiningWorkers()
+
+	bc.pow.mux.Lock()
+	bc.pow.active++
+	bc.pow.difficulty = difficulty
+	bc.pow.started = time.Now()
+	atomic.StoreUint64(&bc.pow.hashes, 0)
+	bc.pow.mux.Unlock()
+
+	next := int64(-powBatchSize)
+	found := int64(-1)
+	var stop int32
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			header := guess
+			for atomic.LoadInt32(&stop) == 0 {
+				if bc.tipEpoch() != epoch {
+					atomic.StoreInt32(&stop, 1)
+					return
+				}
+				from := atomic.AddInt64(&next, powBatchSize)
+				for nonce := from; nonce < from+powBatchSize; nonce++ {
+					header.Nonce = int(nonce)
+					if hasLeadingZeroBits(header.Hash(), difficulty) {
+						atomic.CompareAndSwapInt64(&found, -1, nonce)
+						atomic.StoreInt32(&stop, 1)
+						atomic.AddUint64(&bc.pow.hashes, uint64(nonce-from+1))
+						return
+					}
+				}
+				atomic.AddUint64(&bc.pow.hashes, powBatchSize)
+			}
+		}()
+	}
+	wg.Wait()
+
+	bc.pow.mux.Lock()
+	bc.pow.active--
+	hashes := atomic.LoadUint64(&bc.pow.hashes)
+	elapsed := time.Since(bc.pow.started)
+	if elapsed > 0 {
+		bc.pow.hashRate = float64(hashes) / elapsed.Seconds()
+	}
+	bc.pow.mux.Unlock()
+
+	if found < 0 {
+		log.Printf("blockchain: action=pow, status=aborted, hashes=%d, elapsed=%s", hashes, elapsed)
+		return -1, false
+	}
+	log.Printf("blockchain: action=pow, status=success, workers=%d, hashes=%d, elapsed=%s, hash_rate=%.0f",
+		workers, hashes, elapsed, bc.pow.hashRate)
+	return int(found), true
+}
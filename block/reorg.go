@@ -0,0 +1,172 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ReorgEvent チェーンの再編成の結果です。
+// Depthは巻き戻した自ノードのブロックの数(0の場合は今のチェーンの延長)、Addedは新しく適用したブロックの数です。
+// Reinjectedは巻き戻したブロックからプールに戻したトランザクション、Removedは新しいチェーンで承認されたためプールから除いたトランザクションの数です。
+type ReorgEvent struct {
+	AncestorHeight int
+	AncestorHash   [32]byte
+	OldTip         [32]byte
+	NewTip         [32]byte
+	Depth          int
+	Added          int
+	Reinjected     int
+	Removed        int
+	Timestamp      int64
+}
+
+func (re *ReorgEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AncestorHeight int    `json:"ancestor_height"`
+		AncestorHash   string `json:"ancestor_hash"`
+		OldTip         string `json:"old_tip"`
+		NewTip         string `json:"new_tip"`
+		Depth          int    `json:"depth"`
+		Added          int    `json:"added"`
+		Reinjected     int    `json:"reinjected"`
+		Removed        int    `json:"removed"`
+		Timestamp      int64  `json:"timestamp"`
+	}{
+		AncestorHeight: re.AncestorHeight,
+		AncestorHash:   fmt.Sprintf("%x", re.AncestorHash),
+		OldTip:         fmt.Sprintf("%x", re.OldTip),
+		NewTip:         fmt.Sprintf("%x", re.NewTip),
+		Depth:          re.Depth,
+		Added:          re.Added,
+		Reinjected:     re.Reinjected,
+		Removed:        re.Removed,
+		Timestamp:      re.Timestamp,
+	})
+}
+
+// OnReorg チェーンの再編成のたびに呼ばれる関数を登録します。bc.muxを持ったまま呼ばれるので、Blockchainのメソッドを呼ばずにすぐ戻る必要があります。
+func (bc *Blockchain) OnReorg(f func(*ReorgEvent)) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.reorgListeners = append(bc.reorgListeners, f)
+}
+
+// forkHeight 現在のチェーンとchainが最初に分岐する高さを返します。共通の祖先はその1つ前のブロックです。
+func (bc *Blockchain) forkHeight(chain []*Block) int {
+	height := 0
+	for height < len(chain) {
+		b, err := bc.chain.BlockByHeight(height)
+		if err != nil || b.Hash() != chain[height].Hash() {
+			break
+		}
+		height++
+	}
+	return height
+}
+
+// reorganize 次の順にチェーンを再編成し、その結果を返します。
+//  1. 共通の祖先を探し(空のチェーンではAncestorHeightは-1)、確定したブロックを巻き戻すことになる場合はやめます
+//  2. 祖先より後の自ノードのブロック(孤立したブロック)を残高のインデックスから逆順に巻き戻します
+//  3. chainの新しいブロックを保存して適用します
+//  4. 孤立したブロックのトランザクションをプールに戻し、新しいチェーンで承認されたものをプールから除きます
+//  5. 新しい状態で無効になったトランザクションをプールから取り除きます
+func (bc *Blockchain) reorganize(chain []*Block) (*ReorgEvent, error) {
+	fork := bc.forkHeight(chain)
+	if finalized := bc.finalizedHeight(); fork <= finalized {
+		return nil, fmt.Errorf("chain forks at height %d before finalized block %d", fork, finalized)
+	}
+	var orphaned []*Block
+	for h := fork; h < bc.chain.Height(); h++ {
+		b, err := bc.chain.BlockByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		orphaned = append(orphaned, b)
+	}
+	event := &ReorgEvent{
+		AncestorHeight: fork - 1,
+		NewTip:         chain[len(chain)-1].Hash(),
+		Depth:          len(orphaned),
+		Added:          len(chain) - fork,
+		Timestamp:      time.Now().UnixNano(),
+	}
+	if fork > 0 {
+		event.AncestorHash = chain[fork-1].Hash()
+	}
+	if bc.chain.Height() > 0 {
+		event.OldTip = bc.LastBlock().Hash()
+	}
+	if err := bc.chain.ReplaceFrom(fork, chain[fork:]); err != nil {
+		return nil, err
+	}
+	if fork == 0 {
+		bc.tree.reset(chain)
+	} else {
+		bc.tree.addChain(chain)
+	}
+	for i := len(orphaned) - 1; i >= 0; i-- {
+		bc.revertBlock(orphaned[i])
+	}
+	for _, b := range chain[fork:] {
+		bc.applyBlock(b)
+	}
+	bc.tipChanged()
+	event.Reinjected, event.Removed = bc.reinjectTransactions(orphaned, chain[fork:])
+	bc.detectDoubleSigns(orphaned, chain[fork:])
+
+	log.Printf("blockchain: action=reorg, ancestor=%d, depth=%d, added=%d, reinjected=%d, removed=%d, old_tip=%x, new_tip=%x",
+		event.AncestorHeight, event.Depth, event.Added, event.Reinjected, event.Removed, event.OldTip, event.NewTip)
+	for _, f := range bc.reorgListeners {
+		f(event)
+	}
+	return event, nil
+}
+
+// reinjectTransactions 孤立したブロックのトランザクション(マイニング報酬を除く)をプールの先頭に戻し、
+// 新しいブロックに含まれるトランザクションをプールから除きます。戻した数と除いた数を返します。
+// 孤立したブロックのトランザクションはプールのものより前に作られているので、同じ送信者のnonceの順を保つよう先頭に置きます。
+func (bc *Blockchain) reinjectTransactions(orphaned []*Block, added []*Block) (int, int) {
+	confirmed := make(map[string]bool)
+	for _, b := range added {
+		for _, t := range b.Transactions {
+			confirmed[t.ID()] = true
+		}
+	}
+	pooled := make(map[string]bool, len(bc.transactionPool))
+	for _, t := range bc.transactionPool {
+		pooled[t.ID()] = true
+	}
+
+	var pool []*Transaction
+	reinjected := make(map[string]bool)
+	for _, b := range orphaned {
+		for _, t := range b.Transactions {
+			id := t.ID()
+			if t.SenderBlockchainAddress == MiningSender || confirmed[id] || pooled[id] || reinjected[id] {
+				continue
+			}
+			reinjected[id] = true
+			pool = append(pool, t)
+		}
+	}
+	removed := 0
+	for _, t := range bc.transactionPool {
+		if confirmed[t.ID()] {
+			removed++
+			continue
+		}
+		pool = append(pool, t)
+	}
+	bc.transactionPool = pool
+	bc.pruneTransactionPool()
+
+	kept := 0
+	for _, t := range bc.transactionPool {
+		if reinjected[t.ID()] {
+			kept++
+		}
+	}
+	return kept, removed
+}
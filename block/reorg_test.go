@@ -0,0 +1,91 @@
+package block
+
+import "testing"
+
+// mineBlocks bcでn個のブロックをマイニングします。
+func mineBlocks(t *testing.T, bc *Blockchain, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if !bc.Mining() {
+			t.Fatal("mining failed")
+		}
+	}
+}
+
+// TestReorganize 巻き戻したブロックのトランザクションが新しいチェーンでも有効ならプールに戻ることを確認します。
+func TestReorganize(t *testing.T) {
+	key, alice := newTestKey(t)
+	a := newTestBlockchain(t, alice)
+	b := forkBlockchain(t, a, "bob", 1)
+
+	tx := signedTransfer(t, key, "carol", Coin/2, 0, 0)
+	if !a.AddSignedTransaction(tx) {
+		t.Fatal("transaction was rejected")
+	}
+	mineBlocks(t, a, 1)
+	mineBlocks(t, b, 2)
+
+	var events []*ReorgEvent
+	a.OnReorg(func(e *ReorgEvent) {
+		events = append(events, e)
+	})
+	oldTip := a.LastBlock().Hash()
+	a.mux.Lock()
+	event, err := a.reorganize(b.Chain())
+	a.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReorgEvent{AncestorHeight: 1, AncestorHash: b.storedBlockAt(1).Hash(), OldTip: oldTip, NewTip: b.LastBlock().Hash(), Depth: 1, Added: 2, Reinjected: 1}
+	event.Timestamp = 0
+	if *event != want {
+		t.Errorf("event = %+v, want %+v", *event, want)
+	}
+	if len(events) != 1 || events[0] != event {
+		t.Errorf("listener received %d events", len(events))
+	}
+	if err := a.CheckBalanceIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.CalculateTotalAmount("carol"); got != 0 {
+		t.Errorf("confirmed balance of carol = %s, want 0", got)
+	}
+	if got := a.PendingAmount("carol"); got != Coin/2 {
+		t.Errorf("pending balance of carol = %s, want %s", got, Coin/2)
+	}
+
+	// 戻したトランザクションは新しいチェーンの続きに入ります
+	mineBlocks(t, a, 1)
+	if status, err := a.FindTransaction(tx.ID()); err != nil || status.Status != TransactionMined {
+		t.Fatalf("reinjected transaction was not mined: %v, %v", status, err)
+	}
+}
+
+// TestReorganizeDropsInvalidTransactions 新しいチェーンで残高が足りなくなったトランザクションはプールに戻さないことを確認します。
+func TestReorganizeDropsInvalidTransactions(t *testing.T) {
+	key, alice := newTestKey(t)
+	a := newTestBlockchain(t, alice)
+	b := forkBlockchain(t, a, "bob", 0)
+
+	if !a.AddSignedTransaction(signedTransfer(t, key, "carol", Coin/2, 0, 0)) {
+		t.Fatal("transaction was rejected")
+	}
+	mineBlocks(t, a, 1)
+	mineBlocks(t, b, 3)
+
+	a.mux.Lock()
+	event, err := a.reorganize(b.Chain())
+	a.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.AncestorHeight != 0 || event.Depth != 2 || event.Added != 3 || event.Reinjected != 0 {
+		t.Errorf("event = %+v", *event)
+	}
+	if pool := a.TransactionPool(); len(pool) != 0 {
+		t.Errorf("%d transactions in the pool, want none", len(pool))
+	}
+	if err := a.CheckBalanceIndex(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,244 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// ステーク、アンステーク、スラッシングのトランザクションの受取人に使う予約済みのアドレスです。
+const (
+	StakeAddress   = "STAKE"   // Valueを残高からステークに移します
+	UnstakeAddress = "UNSTAKE" // ValueをステークからUnbondingBlocks後に残高に戻します
+	SlashAddress   = "SLASH"   // 二重署名した送信者のステークとアンボンディング中の額を没収します
+)
+
+// UnbondingBlocks アンステークした額が残高に戻るまでのブロック数です。
+// その間はプロポーザーに選ばれませんが、二重署名が見つかれば没収されます。
+const UnbondingBlocks = 20
+
+// RuleStake ステークとスラッシングに関するルールです。
+const (
+	RuleStake = "stake"
+	RuleSlash = "slash"
+)
+
+// IsStake 送信者の残高をステークに移すトランザクションか返します。
+func (t *Transaction) IsStake() bool {
+	return t.RecipientBlockchainAddress == StakeAddress
+}
+
+// IsUnstake 送信者のステークを残高に戻すトランザクションか返します。
+func (t *Transaction) IsUnstake() bool {
+	return t.RecipientBlockchainAddress == UnstakeAddress
+}
+
+// IsSlashing 二重署名の証拠で送信者のステークを没収するトランザクションか返します。署名はなく、Evidenceを持ちます。
+func (t *Transaction) IsSlashing() bool {
+	return t.RecipientBlockchainAddress == SlashAddress
+}
+
+// DoubleSignEvidence 同じ鍵が同じ親(同じ高さ)に続く異なるブロックに署名したことを示す2つのヘッダーです。
+type DoubleSignEvidence struct {
+	First  *BlockHeader
+	Second *BlockHeader
+}
+
+// Verify 2つのヘッダーが同じ親に続く異なるブロックで、どちらも同じ鍵で正しく署名されているか確認し、署名者のアドレスを返します。
+func (e *DoubleSignEvidence) Verify() (string, error) {
+	if e == nil || e.First == nil || e.Second == nil {
+		return "", fmt.Errorf("evidence needs two block headers")
+	}
+	if e.First.PreviousHash != e.Second.PreviousHash {
+		return "", fmt.Errorf("headers do not share a parent block")
+	}
+	if e.First.Hash() == e.Second.Hash() {
+		return "", fmt.Errorf("headers are the same block")
+	}
+	first, ok := verifyHeaderSignature(e.First)
+	if !ok {
+		return "", fmt.Errorf("first header has no valid signature")
+	}
+	second, ok := verifyHeaderSignature(e.Second)
+	if !ok {
+		return "", fmt.Errorf("second header has no valid signature")
+	}
+	if first != second {
+		return "", fmt.Errorf("headers are signed by %s and %s", first, second)
+	}
+	return first, nil
+}
+
+// ID 証拠を一度しか使えないようにするための識別子です。Verifyで確認した証拠にだけ使えます。
+// 同じ鍵が同じ親に続けて署名した二重署名は、ヘッダーの組や順序によらず同じIDになります。
+func (e *DoubleSignEvidence) ID() [32]byte {
+	signer := utils.AddressFromPublicKey(e.First.Signer)
+	return sha256.Sum256(append(e.First.PreviousHash[:], signer...))
+}
+
+func (e *DoubleSignEvidence) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		First  *BlockHeader `json:"first"`
+		Second *BlockHeader `json:"second"`
+	}{
+		First:  e.First,
+		Second: e.Second,
+	})
+}
+
+func (e *DoubleSignEvidence) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		First  **BlockHeader `json:"first"`
+		Second **BlockHeader `json:"second"`
+	}{
+		First:  &e.First,
+		Second: &e.Second,
+	}
+	return json.Unmarshal(data, v)
+}
+
+// StakeInfo アドレスとそのステークです。
+type StakeInfo struct {
+	Address string
+	Stake   Amount
+}
+
+func (si *StakeInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Address string `json:"address"`
+		Stake   Amount `json:"stake"`
+	}{
+		Address: si.Address,
+		Stake:   si.Stake,
+	})
+}
+
+// sortedStakes ステークを持つアドレスをアドレスの順に並べます。プロポーザーの選択はこの順で行います。
+func sortedStakes(stakes map[string]Amount) []*StakeInfo {
+	infos := make([]*StakeInfo, 0, len(stakes))
+	for address, stake := range stakes {
+		if stake > 0 {
+			infos = append(infos, &StakeInfo{Address: address, Stake: stake})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
+	return infos
+}
+
+// Stake addressの承認済みのステークを返します。
+func (bc *Blockchain) Stake(address string) Amount {
+	return bc.state.Stake(address)
+}
+
+// Unbonding addressがアンステークしてまだ残高に戻っていない額です。
+func (bc *Blockchain) Unbonding(address string) Amount {
+	return bc.state.Unbonding(address)
+}
+
+// Stakes ステークを持つ全てのアドレスをアドレスの順に返します。
+func (bc *Blockchain) Stakes() []*StakeInfo {
+	return sortedStakes(bc.state.Stakes())
+}
+
+// PendingUnstake プールにあるaddressのアンステークの合計です。
+func (bc *Blockchain) PendingUnstake(address string) Amount {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.pendingUnstake(address)
+}
+
+func (bc *Blockchain) pendingUnstake(address string) Amount {
+	var total Amount
+	for _, t := range bc.transactionPool {
+		if t.SenderBlockchainAddress == address && (t.IsUnstake() || t.IsSlashing()) {
+			total += t.Value
+		}
+	}
+	return total
+}
+
+// NewSlashingTransaction 証拠の署名者のステークとアンボンディング中の額を全て没収するトランザクションを作成します。
+// Valueは作成した時点の額で、ブロックに入ったときにはその時点にある額を全て没収します。
+func (bc *Blockchain) NewSlashingTransaction(evidence *DoubleSignEvidence) (*Transaction, error) {
+	offender, err := evidence.Verify()
+	if err != nil {
+		return nil, err
+	}
+	if bc.state.EvidenceUsed(evidence.ID()) {
+		return nil, fmt.Errorf("evidence against %s was already used", offender)
+	}
+	stake := bc.Stake(offender) + bc.Unbonding(offender)
+	if stake <= 0 {
+		return nil, fmt.Errorf("%s has no stake to slash", offender)
+	}
+	t := NewTransaction(offender, SlashAddress, stake)
+	t.Evidence = evidence
+	return t, nil
+}
+
+// AddDoubleSignEvidence 二重署名の証拠からスラッシングのトランザクションを作り、プールに追加します。
+func (bc *Blockchain) AddDoubleSignEvidence(evidence *DoubleSignEvidence) error {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.addDoubleSignEvidence(evidence)
+}
+
+func (bc *Blockchain) addDoubleSignEvidence(evidence *DoubleSignEvidence) error {
+	t, err := bc.NewSlashingTransaction(evidence)
+	if err != nil {
+		return err
+	}
+	for _, p := range bc.transactionPool {
+		if p.IsSlashing() && p.SenderBlockchainAddress == t.SenderBlockchainAddress {
+			return fmt.Errorf("%s is already being slashed", t.SenderBlockchainAddress)
+		}
+	}
+	log.Printf("blockchain: action=slash, offender=%s, stake=%s", t.SenderBlockchainAddress, t.Value)
+	bc.addToPool(t)
+	return nil
+}
+
+// ReportDoubleSign 証拠をプールに追加し、成功したら隣接ノードにも送ります。
+func (bc *Blockchain) ReportDoubleSign(evidence *DoubleSignEvidence) error {
+	if err := bc.AddDoubleSignEvidence(evidence); err != nil {
+		return err
+	}
+	m, _ := json.Marshal(evidence)
+	for _, n := range bc.neighbors {
+		endpoint := fmt.Sprintf("http://%s/evidence", n)
+		client := &http.Client{}
+		req, err := http.NewRequest("PUT", endpoint, bytes.NewBuffer(m))
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			continue
+		}
+		log.Printf("Evidence at %v: %v", n, resp.Status)
+	}
+	return nil
+}
+
+// detectDoubleSigns 置き換えで捨てるブロックと新しいチェーンのブロックのうち、同じ親に続いて同じ鍵で署名されたものを報告します。
+func (bc *Blockchain) detectDoubleSigns(orphaned []*Block, chain []*Block) {
+	if len(orphaned) == 0 || len(chain) == 0 {
+		return
+	}
+	evidence := &DoubleSignEvidence{First: orphaned[0].Header(), Second: chain[0].Header()}
+	if _, err := evidence.Verify(); err != nil {
+		return
+	}
+	if err := bc.addDoubleSignEvidence(evidence); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
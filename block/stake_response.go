@@ -0,0 +1,26 @@
+package block
+
+import "encoding/json"
+
+// StakesResponse ステークを持つアドレスの一覧と、その合計です。
+type StakesResponse struct {
+	Stakes []*StakeInfo `json:"stakes"`
+}
+
+func (sr *StakesResponse) MarshalJSON() ([]byte, error) {
+	stakes := sr.Stakes
+	if stakes == nil {
+		stakes = []*StakeInfo{}
+	}
+	var total Amount
+	for _, si := range stakes {
+		total += si.Stake
+	}
+	return json.Marshal(struct {
+		Stakes     []*StakeInfo `json:"stakes"`
+		TotalStake Amount       `json:"total_stake"`
+	}{
+		Stakes:     stakes,
+		TotalStake: total,
+	})
+}
@@ -0,0 +1,114 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"testing"
+)
+
+// stakingState aliceにGenesisStakeで10コインのステークを持たせたジェネシスブロックを適用した状態を返します。
+func stakingState(t *testing.T) (*accountState, *ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, alice := newTestKey(t)
+	genesis := NewBlock(0, [32]byte{}, 0, nil)
+	genesis.Config = &ChainConfig{GenesisStake: map[string]Amount{alice: 10 * Coin}}
+	s := newAccountState()
+	s.applyBlock(genesis)
+	return s, key, alice
+}
+
+// applyVerified 高さheightのブロックを検証しながら適用した状態と、そのまま適用した状態が一致するか確認します。
+func applyVerified(t *testing.T, s *accountState, height int, b *Block) {
+	t.Helper()
+	scratch := s.clone()
+	if err := verifyBlockTransactions(height, b, 0, scratch, nil); err != nil {
+		t.Fatalf("block %d: %v", height, err)
+	}
+	s.applyBlock(b)
+	if err := s.diff(scratch); err != nil {
+		t.Fatalf("block %d: verified and applied states differ: %v", height, err)
+	}
+}
+
+// doubleSign keyで同じ親に続く2つのヘッダーに署名した証拠を作成します。
+func doubleSign(t *testing.T, key *ecdsa.PrivateKey, parent [32]byte) *DoubleSignEvidence {
+	t.Helper()
+	first, second := NewBlock(1, parent, 0, nil).Header(), NewBlock(2, parent, 0, nil).Header()
+	if err := signHeader(key, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := signHeader(key, second); err != nil {
+		t.Fatal(err)
+	}
+	return &DoubleSignEvidence{First: first, Second: second}
+}
+
+func slashing(offender string, evidence *DoubleSignEvidence) *Transaction {
+	tx := NewTransaction(offender, SlashAddress, Coin)
+	tx.Evidence = evidence
+	return tx
+}
+
+func TestUnbonding(t *testing.T) {
+	s, key, alice := stakingState(t)
+	blocks := []*Block{NewBlock(0, [32]byte{1}, 0, []*Transaction{signedTransfer(t, key, UnstakeAddress, 4*Coin, 0, 0)})}
+	applyVerified(t, s, 1, blocks[0])
+	unstaked := s.clone()
+	if s.Stake(alice) != 6*Coin || s.Unbonding(alice) != 4*Coin || s.Balance(alice) != 0 {
+		t.Fatalf("after unstaking: stake %s, unbonding %s, balance %s", s.Stake(alice), s.Unbonding(alice), s.Balance(alice))
+	}
+
+	for height := 2; height <= 1+UnbondingBlocks; height++ {
+		if s.Balance(alice) != 0 {
+			t.Fatalf("unstaked amount was released at height %d", height-1)
+		}
+		b := NewBlock(0, [32]byte{byte(height)}, 0, nil)
+		blocks = append(blocks, b)
+		applyVerified(t, s, height, b)
+	}
+	if s.Balance(alice) != 4*Coin || s.Unbonding(alice) != 0 {
+		t.Fatalf("after the unbonding period: balance %s, unbonding %s", s.Balance(alice), s.Unbonding(alice))
+	}
+
+	for i := len(blocks) - 1; i >= 1; i-- {
+		s.revertBlock(blocks[i])
+	}
+	if err := s.diff(unstaked); err != nil {
+		t.Fatalf("revert did not restore the unbonding amount: %v", err)
+	}
+}
+
+func TestSlashing(t *testing.T) {
+	s, key, alice := stakingState(t)
+	applyVerified(t, s, 1, NewBlock(0, [32]byte{1}, 0, []*Transaction{signedTransfer(t, key, UnstakeAddress, 4*Coin, 0, 0)}))
+	before := s.clone()
+
+	// スラッシングのValueによらず、適用した時点のステークとアンボンディング中の額を全て没収します
+	evidence := doubleSign(t, key, [32]byte{1})
+	b := NewBlock(0, [32]byte{2}, 0, []*Transaction{slashing(alice, evidence)})
+	applyVerified(t, s, 2, b)
+	if s.Stake(alice) != 0 || s.Unbonding(alice) != 0 {
+		t.Fatalf("after slashing: stake %s, unbonding %s", s.Stake(alice), s.Unbonding(alice))
+	}
+	if !s.EvidenceUsed(evidence.ID()) {
+		t.Fatal("evidence was not recorded")
+	}
+
+	swapped := &DoubleSignEvidence{First: evidence.Second, Second: evidence.First}
+	reused := NewBlock(0, [32]byte{3}, 0, []*Transaction{slashing(alice, swapped)})
+	err := verifyBlockTransactions(3, reused, 0, s.clone(), nil)
+	if cve, ok := err.(*ChainValidationError); !ok || cve.Rule != RuleSlash {
+		t.Fatalf("reused evidence: got %v, want rule %s", err, RuleSlash)
+	}
+	twice := NewBlock(0, [32]byte{3}, 0, []*Transaction{slashing(alice, evidence), slashing(alice, swapped)})
+	if err := verifyBlockTransactions(2, twice, 0, before.clone(), nil); err == nil {
+		t.Fatal("the same evidence was used twice in one block")
+	}
+
+	s.revertBlock(b)
+	if err := s.diff(before); err != nil {
+		t.Fatalf("revert did not restore the slashed stake: %v", err)
+	}
+	if s.EvidenceUsed(evidence.ID()) {
+		t.Fatal("evidence is still used after the revert")
+	}
+}
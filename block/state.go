@@ -0,0 +1,362 @@
+package block
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// accountState アドレスごとの承認済みの残高とnonce、ステークです。ブロックの追加で更新し、チェーンの再編成では巻き戻します。
+// アンステークした額は残高に戻るまでunbondingに、使用済みの二重署名の証拠はevidenceに記録します。
+type accountState struct {
+	balances  map[string]Amount
+	nonces    map[string]uint64
+	stakes    map[string]Amount
+	unbonding map[string][]unbondingEntry
+	evidence  map[[32]byte]bool
+	undo      map[int]*stateUndo
+	height    int // 最後に適用したブロックの高さです。何も適用していなければ-1です
+	mux       sync.RWMutex
+}
+
+// unbondingEntry アンステークした額と、それが残高に戻る高さです。
+type unbondingEntry struct {
+	Release int
+	Amount  Amount
+}
+
+// stateUndo ブロックを巻き戻すためにトランザクションからは分からない変更を取っておきます。
+type stateUndo struct {
+	released map[string][]unbondingEntry
+	slashed  []slashRecord
+}
+
+// slashRecord スラッシングで没収したステークとアンボンディング中の額です。
+type slashRecord struct {
+	address   string
+	stake     Amount
+	unbonding []unbondingEntry
+}
+
+func newAccountState() *accountState {
+	return &accountState{
+		balances:  make(map[string]Amount),
+		nonces:    make(map[string]uint64),
+		stakes:    make(map[string]Amount),
+		unbonding: make(map[string][]unbondingEntry),
+		evidence:  make(map[[32]byte]bool),
+		undo:      make(map[int]*stateUndo),
+		height:    -1,
+	}
+}
+
+// clone ブロックを適用せずに検証するための状態のコピーを返します。コピーを巻き戻せるよう巻き戻しの記録もコピーします。
+func (s *accountState) clone() *accountState {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	c := newAccountState()
+	for address, balance := range s.balances {
+		c.balances[address] = balance
+	}
+	for address, nonce := range s.nonces {
+		c.nonces[address] = nonce
+	}
+	for address, stake := range s.stakes {
+		c.stakes[address] = stake
+	}
+	for address, entries := range s.unbonding {
+		c.unbonding[address] = append([]unbondingEntry(nil), entries...)
+	}
+	for id := range s.evidence {
+		c.evidence[id] = true
+	}
+	for height, u := range s.undo {
+		released := make(map[string][]unbondingEntry, len(u.released))
+		for address, entries := range u.released {
+			released[address] = entries
+		}
+		c.undo[height] = &stateUndo{released: released, slashed: append([]slashRecord(nil), u.slashed...)}
+	}
+	c.height = s.height
+	return c
+}
+
+func (s *accountState) Balance(address string) Amount {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.balances[address]
+}
+
+func (s *accountState) Nonce(address string) uint64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.nonces[address]
+}
+
+func (s *accountState) Stake(address string) Amount {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.stakes[address]
+}
+
+// Unbonding addressがアンステークしてまだ残高に戻っていない額の合計です。
+func (s *accountState) Unbonding(address string) Amount {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	var total Amount
+	for _, e := range s.unbonding[address] {
+		total += e.Amount
+	}
+	return total
+}
+
+// EvidenceUsed 二重署名の証拠idが既にスラッシングに使われたか返します。
+func (s *accountState) EvidenceUsed(id [32]byte) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.evidence[id]
+}
+
+// Stakes ステークを持つアドレスとその額の一覧です。
+func (s *accountState) Stakes() map[string]Amount {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	stakes := make(map[string]Amount, len(s.stakes))
+	for address, stake := range s.stakes {
+		if stake > 0 {
+			stakes[address] = stake
+		}
+	}
+	return stakes
+}
+
+// undoAt 高さheightのブロックの巻き戻しの記録を返します。なければ作ります。
+func (s *accountState) undoAt(height int) *stateUndo {
+	u, ok := s.undo[height]
+	if !ok {
+		u = &stateUndo{released: make(map[string][]unbondingEntry)}
+		s.undo[height] = u
+	}
+	return u
+}
+
+// release 高さheightで期間の終わるアンボンディング中の額を残高に戻します。
+func (s *accountState) release(height int) {
+	for address, entries := range s.unbonding {
+		n := 0
+		for n < len(entries) && entries[n].Release <= height {
+			s.balances[address] += entries[n].Amount
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		u := s.undoAt(height)
+		u.released[address] = entries[:n]
+		if n == len(entries) {
+			delete(s.unbonding, address)
+		} else {
+			s.unbonding[address] = entries[n:]
+		}
+	}
+}
+
+// unrelease releaseを取り消し、残高に戻した額をアンボンディング中に戻します。
+func (s *accountState) unrelease(height int) {
+	u, ok := s.undo[height]
+	if !ok {
+		return
+	}
+	for address, entries := range u.released {
+		for _, e := range entries {
+			s.balances[address] -= e.Amount
+		}
+		s.unbonding[address] = append(append([]unbondingEntry(nil), entries...), s.unbonding[address]...)
+	}
+	delete(s.undo, height)
+}
+
+// unbond 高さheightのブロックでaddressがアンステークしたvalueを、UnbondingBlocks後に残高に戻るよう記録します。
+func (s *accountState) unbond(height int, address string, value Amount) {
+	s.stakes[address] -= value
+	s.unbonding[address] = append(s.unbonding[address], unbondingEntry{Release: height + UnbondingBlocks, Amount: value})
+}
+
+// rebond unbondを取り消します。
+func (s *accountState) rebond(address string, value Amount) {
+	entries := s.unbonding[address]
+	entries = entries[:len(entries)-1]
+	if len(entries) == 0 {
+		delete(s.unbonding, address)
+	} else {
+		s.unbonding[address] = entries
+	}
+	s.stakes[address] += value
+}
+
+// slash スラッシングのトランザクションの送信者のステークとアンボンディング中の額を、適用した時点にある分だけ没収し、証拠を使用済みにします。
+func (s *accountState) slash(height int, t *Transaction) {
+	offender := t.SenderBlockchainAddress
+	u := s.undoAt(height)
+	u.slashed = append(u.slashed, slashRecord{address: offender, stake: s.stakes[offender], unbonding: s.unbonding[offender]})
+	s.stakes[offender] = 0
+	delete(s.unbonding, offender)
+	s.evidence[t.Evidence.ID()] = true
+}
+
+// unslash slashを取り消し、没収した額を戻します。
+func (s *accountState) unslash(height int, t *Transaction) {
+	u := s.undo[height]
+	r := u.slashed[len(u.slashed)-1]
+	u.slashed = u.slashed[:len(u.slashed)-1]
+	s.stakes[r.address] = r.stake
+	if len(r.unbonding) > 0 {
+		s.unbonding[r.address] = append([]unbondingEntry(nil), r.unbonding...)
+	}
+	delete(s.evidence, t.Evidence.ID())
+}
+
+// applyBlock ブロックのトランザクションを順番に適用します。ブロックは検証済みである必要があります。
+// ジェネシスブロックではチェーン設定のGenesisStakeをステークに加えます。
+func (s *accountState) applyBlock(b *Block) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	height := s.height + 1
+	if b.Config != nil {
+		for address, stake := range b.Config.GenesisStake {
+			s.stakes[address] += stake
+		}
+	}
+	s.release(height)
+	for _, t := range b.Transactions {
+		s.transact(height, t, 1)
+	}
+	s.height = height
+}
+
+// transact 高さheightのブロックのトランザクションをsign=1で適用、sign=-1で取り消します。
+// ステーク、アンステーク、スラッシングのトランザクションは残高の代わりに送信者のステークを増減します。
+func (s *accountState) transact(height int, t *Transaction, sign Amount) {
+	sender := t.SenderBlockchainAddress
+	switch {
+	case sender == MiningSender:
+		s.balances[t.RecipientBlockchainAddress] += sign * t.Value
+		return
+	case t.IsSlashing():
+		if sign > 0 {
+			s.slash(height, t)
+		} else {
+			s.unslash(height, t)
+		}
+		return
+	case t.IsStake():
+		s.balances[sender] -= sign * (t.Value + t.Fee)
+		s.stakes[sender] += sign * t.Value
+	case t.IsUnstake():
+		s.balances[sender] -= sign * t.Fee
+		if sign > 0 {
+			s.unbond(height, sender, t.Value)
+		} else {
+			s.rebond(sender, t.Value)
+		}
+	default:
+		s.balances[sender] -= sign * (t.Value + t.Fee)
+		s.balances[t.RecipientBlockchainAddress] += sign * t.Value
+	}
+	if sign > 0 {
+		s.nonces[sender]++
+	} else {
+		s.nonces[sender]--
+	}
+}
+
+// revertBlock applyBlockを逆順に取り消します。
+func (s *accountState) revertBlock(b *Block) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	height := s.height
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		s.transact(height, b.Transactions[i], -1)
+	}
+	s.unrelease(height)
+	delete(s.undo, height)
+	if b.Config != nil {
+		for address, stake := range b.Config.GenesisStake {
+			s.stakes[address] -= stake
+		}
+	}
+	s.height = height - 1
+}
+
+// diff 2つの状態を比べ、最初に見つかった違いを返します。
+func (s *accountState) diff(other *accountState) error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	other.mux.RLock()
+	defer other.mux.RUnlock()
+	for _, pair := range [][2]*accountState{{s, other}, {other, s}} {
+		for address, balance := range pair[0].balances {
+			if pair[1].balances[address] != balance {
+				return fmt.Errorf("balance of %s: index %s, scan %s", address, s.balances[address], other.balances[address])
+			}
+		}
+		for address, nonce := range pair[0].nonces {
+			if pair[1].nonces[address] != nonce {
+				return fmt.Errorf("nonce of %s: index %d, scan %d", address, s.nonces[address], other.nonces[address])
+			}
+		}
+		for address, stake := range pair[0].stakes {
+			if pair[1].stakes[address] != stake {
+				return fmt.Errorf("stake of %s: index %s, scan %s", address, s.stakes[address], other.stakes[address])
+			}
+		}
+		for address, entries := range pair[0].unbonding {
+			if !reflect.DeepEqual(pair[1].unbonding[address], entries) {
+				return fmt.Errorf("unbonding of %s: index %v, scan %v", address, s.unbonding[address], other.unbonding[address])
+			}
+		}
+		for id := range pair[0].evidence {
+			if !pair[1].evidence[id] {
+				return fmt.Errorf("evidence %x: index %t, scan %t", id, s.evidence[id], other.evidence[id])
+			}
+		}
+	}
+	return nil
+}
+
+// applyBlock チェーンの台帳の方式に合わせて、残高のインデックスかUTXOの集合にブロックを適用します。
+func (bc *Blockchain) applyBlock(b *Block) {
+	bc.supply += blockIssuance(b)
+	if bc.config.UTXO() {
+		bc.utxos.applyBlock(b)
+		return
+	}
+	bc.state.applyBlock(b)
+}
+
+func (bc *Blockchain) revertBlock(b *Block) {
+	bc.supply -= blockIssuance(b)
+	if bc.config.UTXO() {
+		bc.utxos.revertBlock(b)
+		return
+	}
+	bc.state.revertBlock(b)
+}
+
+// CheckBalanceIndex チェーンを最初から走査して作り直した状態と、残高のインデックスを比べます。
+func (bc *Blockchain) CheckBalanceIndex() error {
+	if bc.config.UTXO() {
+		scanned := newUTXOSet()
+		bc.chain.Iterate(func(_ int, b *Block) bool {
+			scanned.applyBlock(b)
+			return true
+		})
+		return bc.utxos.diff(scanned)
+	}
+	scanned := newAccountState()
+	bc.chain.Iterate(func(_ int, b *Block) bool {
+		scanned.applyBlock(b)
+		return true
+	})
+	return bc.state.diff(scanned)
+}
@@ -0,0 +1,26 @@
+package block
+
+import "testing"
+
+func TestCheckBalanceIndex(t *testing.T) {
+	key, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+	if !bc.AddSignedTransaction(signedTransfer(t, key, "bob", Coin/2, Coin/10, 0)) {
+		t.Fatal("transaction was rejected")
+	}
+	mineBlocks(t, bc, 1)
+	if err := bc.CheckBalanceIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if got := bc.CalculateTotalAmount("bob"); got != Coin/2 {
+		t.Errorf("balance of bob = %s, want %s", got, Coin/2)
+	}
+	if got := bc.ConfirmedNonce(alice); got != 1 {
+		t.Errorf("nonce of alice = %d, want 1", got)
+	}
+
+	bc.state.balances["bob"]++
+	if err := bc.CheckBalanceIndex(); err == nil {
+		t.Error("a corrupted balance was not detected")
+	}
+}
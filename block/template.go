@@ -0,0 +1,97 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// BlockTemplate マイニングの対象になるブロックのヘッダーとトランザクションのスナップショットです。
+// プルーフオブワークはHeader(タイムスタンプを含む)に対して行い、見つかったnonceでこの内容のままブロックにします。
+type BlockTemplate struct {
+	Height       int
+	Header       BlockHeader
+	Transactions []*Transaction
+	epoch        uint64 // 作成したときのtipEpoch
+}
+
+// NewBlockTemplate プールからトランザクションを選び、現在の先頭に続くブロックのテンプレートを作成します。
+func (bc *Blockchain) NewBlockTemplate() (*BlockTemplate, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.newBlockTemplate()
+}
+
+func (bc *Blockchain) newBlockTemplate() (*BlockTemplate, error) {
+	bc.pruneTransactionPool()
+	transactions := bc.assembleTransactions()
+	parent := bc.LastBlock()
+	timestamp := time.Now().UnixNano()
+	if timestamp <= parent.Timestamp {
+		timestamp = parent.Timestamp + 1
+	}
+	tmpl := &BlockTemplate{
+		Height: bc.chain.Height(),
+		Header: BlockHeader{
+			Timestamp:    timestamp,
+			PreviousHash: parent.Hash(),
+			MerkleRoot:   TransactionsMerkleRoot(transactions),
+		},
+		Transactions: transactions,
+		epoch:        bc.tipEpoch(),
+	}
+	if err := bc.engine.Prepare(bc.storedBlockAt, tmpl.Height, &tmpl.Header); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Block nonceを設定したテンプレートのブロックを返します。
+func (tmpl *BlockTemplate) Block(nonce int) *Block {
+	return &Block{
+		Timestamp:    tmpl.Header.Timestamp,
+		Nonce:        nonce,
+		Difficulty:   tmpl.Header.Difficulty,
+		PreviousHash: tmpl.Header.PreviousHash,
+		MerkleRoot:   tmpl.Header.MerkleRoot,
+		Signer:       tmpl.Header.Signer,
+		Signature:    tmpl.Header.Signature,
+		Transactions: tmpl.Transactions,
+	}
+}
+
+func (tmpl *BlockTemplate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Height       int            `json:"height"`
+		Header       *BlockHeader   `json:"header"`
+		Transactions []*Transaction `json:"transactions"`
+	}{
+		Height:       tmpl.Height,
+		Header:       &tmpl.Header,
+		Transactions: tmpl.Transactions,
+	})
+}
+
+// CommitBlock テンプレートを封印したブロックをチェーンに追加します。
+// テンプレートを作成した後に先頭が変わっていた場合や、ブロックがテンプレートと違う場合、
+// 合意のルールを満たさない場合は追加しません。
+func (bc *Blockchain) CommitBlock(tmpl *BlockTemplate, b *Block) (*Block, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if bc.tipEpoch() != tmpl.epoch || bc.LastBlock().Hash() != tmpl.Header.PreviousHash {
+		return nil, fmt.Errorf("template for height %d is stale", tmpl.Height)
+	}
+	if b.PreviousHash != tmpl.Header.PreviousHash || b.MerkleRoot != tmpl.Header.MerkleRoot || b.Timestamp != tmpl.Header.Timestamp {
+		return nil, fmt.Errorf("block does not match the template for height %d", tmpl.Height)
+	}
+	if err := bc.engine.VerifyHeader(bc.storedBlockAt, tmpl.Height, b.Header()); err != nil {
+		return nil, err
+	}
+	if err := bc.verifyBlock(tmpl.Height, b); err != nil {
+		return nil, err
+	}
+	if bc.addBlock(b) == nil {
+		return nil, fmt.Errorf("could not store block %d", tmpl.Height)
+	}
+	return b, nil
+}
@@ -0,0 +1,27 @@
+package block
+
+import "encoding/json"
+
+// TipsResponse ブロックの木にある全てのチェーンの末尾と、親を待っている孤立ブロックです。
+type TipsResponse struct {
+	Tips    []*ChainTip    `json:"tips"`
+	Orphans []*OrphanBlock `json:"orphans"`
+}
+
+func (tr *TipsResponse) MarshalJSON() ([]byte, error) {
+	tips := tr.Tips
+	if tips == nil {
+		tips = []*ChainTip{}
+	}
+	orphans := tr.Orphans
+	if orphans == nil {
+		orphans = []*OrphanBlock{}
+	}
+	return json.Marshal(struct {
+		Tips    []*ChainTip    `json:"tips"`
+		Orphans []*OrphanBlock `json:"orphans"`
+	}{
+		Tips:    tips,
+		Orphans: orphans,
+	})
+}
@@ -1,6 +1,10 @@
 package block
 
 import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -9,10 +13,17 @@ import (
 type Transaction struct {
 	SenderBlockchainAddress    string
 	RecipientBlockchainAddress string
-	Value                      float32
+	Value                      Amount
+	Fee                        Amount // マイナーに支払う手数料
+	Nonce                      uint64 // 送信者ごとの連番。マイニング報酬ではブロックの高さ
+	SenderPublicKey            *ecdsa.PublicKey
+	Signature                  *utils.Signature
+	Inputs                     []OutPoint          // UTXO方式のみ。使う出力
+	Outputs                    []TxOutput          // UTXO方式のみ。先頭がRecipientへのValue、残りはお釣りなど
+	Evidence                   *DoubleSignEvidence // スラッシングのトランザクションのみ
 }
 
-func NewTransaction(sender, recipient string, value float32) *Transaction {
+func NewTransaction(sender, recipient string, value Amount) *Transaction {
 	return &Transaction{
 		SenderBlockchainAddress:    sender,
 		RecipientBlockchainAddress: recipient,
@@ -20,34 +31,166 @@ func NewTransaction(sender, recipient string, value float32) *Transaction {
 	}
 }
 
+// NewSignedTransaction 送信者の公開鍵と署名を持つトランザクションを作成します。
+func NewSignedTransaction(sender, recipient string, value Amount, fee Amount, nonce uint64,
+	senderPublicKey *ecdsa.PublicKey, s *utils.Signature) *Transaction {
+	t := NewTransaction(sender, recipient, value)
+	t.Fee = fee
+	t.Nonce = nonce
+	t.SenderPublicKey = senderPublicKey
+	t.Signature = s
+	return t
+}
+
 func (t *Transaction) Print() {
 	fmt.Printf("%s\n", strings.Repeat("-", 40))
 	fmt.Printf("Sender Blockchain Address: %s\n", t.SenderBlockchainAddress)
 	fmt.Printf("Recipient Blockchain Address: %s\n", t.RecipientBlockchainAddress)
-	fmt.Printf("Value: %f\n", t.Value)
+	fmt.Printf("Value: %s\n", t.Value)
+	fmt.Printf("Fee: %s\n", t.Fee)
+	fmt.Printf("Nonce: %d\n", t.Nonce)
+	for _, op := range t.Inputs {
+		fmt.Printf("Input: %s\n", op)
+	}
+	for _, o := range t.Outputs {
+		fmt.Printf("Output: %s %s\n", o.Address, o.Value)
+	}
+	if t.Evidence != nil {
+		fmt.Printf("Evidence: %x %x\n", t.Evidence.First.Hash(), t.Evidence.Second.Hash())
+	}
+	if t.Signature != nil {
+		fmt.Printf("Signature: %s\n", t.Signature)
+	}
 }
 
-func (t *Transaction) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`
-		Recipient string  `json:"recipient_blockchain_address"`
-		Value     float32 `json:"value"`
+func (t *Transaction) Hash() [32]byte {
+	m, _ := json.Marshal(t)
+	return sha256.Sum256([]byte(m))
+}
+
+// ID トランザクションを識別する正規のIDです。署名の対象(SigningHash)から計算するので、署名の表現が変わっても変わりません。
+func (t *Transaction) ID() string {
+	return fmt.Sprintf("%x", t.SigningHash())
+}
+
+// SigningHash 署名の対象になるハッシュです。公開鍵と署名自体は含みません。
+func (t *Transaction) SigningHash() [32]byte {
+	m, _ := json.Marshal(struct {
+		Sender    string              `json:"sender_blockchain_address"`
+		Recipient string              `json:"recipient_blockchain_address"`
+		Value     Amount              `json:"value"`
+		Fee       Amount              `json:"fee"`
+		Nonce     uint64              `json:"nonce"`
+		Inputs    []OutPoint          `json:"inputs,omitempty"`
+		Outputs   []TxOutput          `json:"outputs,omitempty"`
+		Evidence  *DoubleSignEvidence `json:"evidence,omitempty"`
 	}{
 		Sender:    t.SenderBlockchainAddress,
 		Recipient: t.RecipientBlockchainAddress,
 		Value:     t.Value,
+		Fee:       t.Fee,
+		Nonce:     t.Nonce,
+		Inputs:    t.Inputs,
+		Outputs:   t.Outputs,
+		Evidence:  t.Evidence,
+	})
+	return sha256.Sum256([]byte(m))
+}
+
+// VerifySignature トランザクションが持つ公開鍵で署名を検証します。
+func (t *Transaction) VerifySignature() bool {
+	if t.SenderPublicKey == nil || t.Signature == nil || t.Signature.R == nil || t.Signature.S == nil {
+		return false
+	}
+	h := t.SigningHash()
+	return ecdsa.Verify(t.SenderPublicKey, h[:], t.Signature.R, t.Signature.S)
+}
+
+func (t *Transaction) MarshalJSON() ([]byte, error) {
+	var publicKey, signature string
+	if t.SenderPublicKey != nil {
+		publicKey = fmt.Sprintf("%064x%064x", t.SenderPublicKey.X.Bytes(), t.SenderPublicKey.Y.Bytes())
+	}
+	if t.Signature != nil {
+		signature = t.Signature.String()
+	}
+	return json.Marshal(struct {
+		ID              string              `json:"id"`
+		Sender          string              `json:"sender_blockchain_address"`
+		Recipient       string              `json:"recipient_blockchain_address"`
+		Value           Amount              `json:"value"`
+		Fee             Amount              `json:"fee"`
+		Nonce           uint64              `json:"nonce"`
+		SenderPublicKey string              `json:"sender_public_key,omitempty"`
+		Signature       string              `json:"signature,omitempty"`
+		Inputs          []OutPoint          `json:"inputs,omitempty"`
+		Outputs         []TxOutput          `json:"outputs,omitempty"`
+		Evidence        *DoubleSignEvidence `json:"evidence,omitempty"`
+	}{
+		ID:              t.ID(),
+		Sender:          t.SenderBlockchainAddress,
+		Recipient:       t.RecipientBlockchainAddress,
+		Value:           t.Value,
+		Fee:             t.Fee,
+		Nonce:           t.Nonce,
+		SenderPublicKey: publicKey,
+		Signature:       signature,
+		Inputs:          t.Inputs,
+		Outputs:         t.Outputs,
+		Evidence:        t.Evidence,
 	})
 }
 
 func (t *Transaction) UnmarshalJSON(data []byte) error {
+	var publicKey, signature string
 	v := &struct {
-		Sender    *string  `json:"sender_blockchain_address"`
-		Recipient *string  `json:"recipient_blockchain_address"`
-		Value     *float32 `json:"value"`
+		Sender          *string              `json:"sender_blockchain_address"`
+		Recipient       *string              `json:"recipient_blockchain_address"`
+		Value           *Amount              `json:"value"`
+		Fee             *Amount              `json:"fee"`
+		Nonce           *uint64              `json:"nonce"`
+		SenderPublicKey *string              `json:"sender_public_key"`
+		Signature       *string              `json:"signature"`
+		Inputs          *[]OutPoint          `json:"inputs"`
+		Outputs         *[]TxOutput          `json:"outputs"`
+		Evidence        **DoubleSignEvidence `json:"evidence"`
 	}{
-		Sender:    &t.SenderBlockchainAddress,
-		Recipient: &t.RecipientBlockchainAddress,
-		Value:     &t.Value,
+		Sender:          &t.SenderBlockchainAddress,
+		Recipient:       &t.RecipientBlockchainAddress,
+		Value:           &t.Value,
+		Fee:             &t.Fee,
+		Nonce:           &t.Nonce,
+		SenderPublicKey: &publicKey,
+		Signature:       &signature,
+		Inputs:          &t.Inputs,
+		Outputs:         &t.Outputs,
+		Evidence:        &t.Evidence,
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	t.SenderPublicKey = nil
+	t.Signature = nil
+	if publicKey != "" {
+		if !isKeyPairHex(publicKey) {
+			return fmt.Errorf("invalid sender_public_key")
+		}
+		t.SenderPublicKey = utils.PublicKeyFromString(publicKey)
+	}
+	if signature != "" {
+		if !isKeyPairHex(signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		t.Signature = utils.SignatureFromString(signature)
+	}
+	return nil
+}
+
+// isKeyPairHex 公開鍵や署名の形式(64桁の16進数2つ)か確認します。
+func isKeyPairHex(s string) bool {
+	if len(s) != 128 {
+		return false
 	}
-	return json.Unmarshal(data, v)
+	_, err := hex.DecodeString(s)
+	return err == nil
 }
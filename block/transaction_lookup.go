@@ -0,0 +1,103 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	TransactionPending = "pending"
+	TransactionMined   = "mined"
+)
+
+// TransactionStatus トランザクションがプールで待っているか、どのブロックに含まれたかを表します。
+type TransactionStatus struct {
+	ID            string
+	Status        string
+	BlockHash     [32]byte
+	Height        int
+	Confirmations int
+	Transaction   *Transaction
+}
+
+func (ts *TransactionStatus) MarshalJSON() ([]byte, error) {
+	v := struct {
+		ID            string       `json:"id"`
+		Status        string       `json:"status"`
+		BlockHash     string       `json:"block_hash,omitempty"`
+		Height        *int         `json:"height,omitempty"`
+		Confirmations int          `json:"confirmations"`
+		Transaction   *Transaction `json:"transaction"`
+	}{
+		ID:            ts.ID,
+		Status:        ts.Status,
+		Confirmations: ts.Confirmations,
+		Transaction:   ts.Transaction,
+	}
+	if ts.Status == TransactionMined {
+		v.BlockHash = fmt.Sprintf("%x", ts.BlockHash)
+		v.Height = &ts.Height
+	}
+	return json.Marshal(v)
+}
+
+// findMinedTransaction チェーンからidのトランザクションを探し、ブロックの高さとブロック内の位置を返します。
+func (bc *Blockchain) findMinedTransaction(id string) (*Block, int, int, error) {
+	var found *Block
+	foundHeight, foundIndex := -1, -1
+	err := bc.chain.Iterate(func(height int, b *Block) bool {
+		for i, t := range b.Transactions {
+			if t.ID() == id {
+				found, foundHeight, foundIndex = b, height, i
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, -1, -1, err
+	}
+	if found == nil {
+		return nil, -1, -1, ErrTransactionNotFound
+	}
+	return found, foundHeight, foundIndex, nil
+}
+
+// FindTransaction idのトランザクションをプールとチェーンから探します。
+func (bc *Blockchain) FindTransaction(id string) (*TransactionStatus, error) {
+	for _, t := range bc.TransactionPool() {
+		if t.ID() == id {
+			return &TransactionStatus{ID: id, Status: TransactionPending, Height: -1, Transaction: t}, nil
+		}
+	}
+	b, height, index, err := bc.findMinedTransaction(id)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionStatus{
+		ID:            id,
+		Status:        TransactionMined,
+		BlockHash:     b.Hash(),
+		Height:        height,
+		Confirmations: bc.chain.Height() - height,
+		Transaction:   b.Transactions[index],
+	}, nil
+}
+
+// TransactionProof チェーンからidのトランザクションを探し、マークルプルーフを作成します。
+func (bc *Blockchain) TransactionProof(id string) (*TransactionProof, error) {
+	b, height, index, err := bc.findMinedTransaction(id)
+	if err != nil {
+		return nil, err
+	}
+	hashes := transactionHashes(b.Transactions)
+	return &TransactionProof{
+		TxID:        id,
+		TxHash:      hashes[index],
+		Transaction: b.Transactions[index],
+		BlockHash:   b.Hash(),
+		Height:      height,
+		Header:      b.Header(),
+		Branch:      MerkleBranch(hashes, index),
+	}, nil
+}
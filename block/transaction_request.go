@@ -1,11 +1,42 @@
 package block
 
+import (
+	"blockchain_smp_go/utils"
+	"fmt"
+)
+
 type TransactionRequest struct {
-	SenderBlockchainAddress    *string  `json:"sender_blockchain_address"`
-	RecipientBlockchainAddress *string  `json:"recipient_blockchain_address"`
-	SenderPublicKey            *string  `json:"sender_public_key"`
-	Value                      *float32 `json:"value"`
-	Signature                  *string  `json:"signature"`
+	SenderBlockchainAddress    *string     `json:"sender_blockchain_address"`
+	RecipientBlockchainAddress *string     `json:"recipient_blockchain_address"`
+	SenderPublicKey            *string     `json:"sender_public_key"`
+	Value                      *Amount     `json:"value"`
+	Fee                        *Amount     `json:"fee"` // 省略した場合は0
+	Nonce                      *uint64     `json:"nonce"`
+	Signature                  *string     `json:"signature"`
+	Inputs                     *[]OutPoint `json:"inputs,omitempty"`  // UTXO方式のみ
+	Outputs                    *[]TxOutput `json:"outputs,omitempty"` // UTXO方式のみ
+}
+
+// NewTransactionRequest 署名済みのトランザクションを他のノードに送るためのリクエストを作成します。
+func NewTransactionRequest(t *Transaction) *TransactionRequest {
+	publicKeyStr := fmt.Sprintf("%064x%064x", t.SenderPublicKey.X.Bytes(), t.SenderPublicKey.Y.Bytes())
+	signatureStr := t.Signature.String()
+	tr := &TransactionRequest{
+		SenderBlockchainAddress:    &t.SenderBlockchainAddress,
+		RecipientBlockchainAddress: &t.RecipientBlockchainAddress,
+		SenderPublicKey:            &publicKeyStr,
+		Value:                      &t.Value,
+		Fee:                        &t.Fee,
+		Nonce:                      &t.Nonce,
+		Signature:                  &signatureStr,
+	}
+	if len(t.Inputs) > 0 {
+		tr.Inputs = &t.Inputs
+	}
+	if len(t.Outputs) > 0 {
+		tr.Outputs = &t.Outputs
+	}
+	return tr
 }
 
 func (tr *TransactionRequest) Validate() bool {
@@ -13,5 +44,27 @@ func (tr *TransactionRequest) Validate() bool {
 		tr.RecipientBlockchainAddress != nil &&
 		tr.SenderPublicKey != nil &&
 		tr.Value != nil &&
+		tr.Nonce != nil &&
 		tr.Signature != nil
 }
+
+// FeeOrZero 手数料を返します。省略されていた場合は0です。
+func (tr *TransactionRequest) FeeOrZero() Amount {
+	if tr.Fee == nil {
+		return 0
+	}
+	return *tr.Fee
+}
+
+// Transaction リクエストから署名済みのトランザクションを作成します。Validateを通ったリクエストに使います。
+func (tr *TransactionRequest) Transaction() *Transaction {
+	t := NewSignedTransaction(*tr.SenderBlockchainAddress, *tr.RecipientBlockchainAddress, *tr.Value, tr.FeeOrZero(), *tr.Nonce,
+		utils.PublicKeyFromString(*tr.SenderPublicKey), utils.SignatureFromString(*tr.Signature))
+	if tr.Inputs != nil {
+		t.Inputs = *tr.Inputs
+	}
+	if tr.Outputs != nil {
+		t.Outputs = *tr.Outputs
+	}
+	return t
+}
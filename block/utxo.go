@@ -0,0 +1,309 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// OutPoint トランザクションの出力を指す参照です。UTXO方式のトランザクションの入力になります。
+type OutPoint struct {
+	TxID  string
+	Index int
+}
+
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%s:%d", op.TxID, op.Index)
+}
+
+func (op OutPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID  string `json:"tx_id"`
+		Index int    `json:"index"`
+	}{
+		TxID:  op.TxID,
+		Index: op.Index,
+	})
+}
+
+func (op *OutPoint) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		TxID  *string `json:"tx_id"`
+		Index *int    `json:"index"`
+	}{
+		TxID:  &op.TxID,
+		Index: &op.Index,
+	}
+	return json.Unmarshal(data, v)
+}
+
+// TxOutput UTXO方式のトランザクションの出力です。
+type TxOutput struct {
+	Address string
+	Value   Amount
+}
+
+func (o TxOutput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Address string `json:"address"`
+		Value   Amount `json:"value"`
+	}{
+		Address: o.Address,
+		Value:   o.Value,
+	})
+}
+
+func (o *TxOutput) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		Address *string `json:"address"`
+		Value   *Amount `json:"value"`
+	}{
+		Address: &o.Address,
+		Value:   &o.Value,
+	}
+	return json.Unmarshal(data, v)
+}
+
+// UTXO まだ使われていない出力です。
+type UTXO struct {
+	OutPoint
+	TxOutput
+}
+
+func (u *UTXO) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID    string `json:"tx_id"`
+		Index   int    `json:"index"`
+		Address string `json:"address"`
+		Value   Amount `json:"value"`
+	}{
+		TxID:    u.TxID,
+		Index:   u.Index,
+		Address: u.Address,
+		Value:   u.Value,
+	})
+}
+
+func (u *UTXO) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		TxID    *string `json:"tx_id"`
+		Index   *int    `json:"index"`
+		Address *string `json:"address"`
+		Value   *Amount `json:"value"`
+	}{
+		TxID:    &u.TxID,
+		Index:   &u.Index,
+		Address: &u.Address,
+		Value:   &u.Value,
+	}
+	return json.Unmarshal(data, v)
+}
+
+// transactionOutputs トランザクションが作る出力を返します。
+// Outputsを持たないトランザクション(マイニング報酬など)はRecipientへのValueを1つの出力とします。
+func transactionOutputs(t *Transaction) []TxOutput {
+	if len(t.Outputs) > 0 {
+		return t.Outputs
+	}
+	return []TxOutput{{Address: t.RecipientBlockchainAddress, Value: t.Value}}
+}
+
+// utxoSet 未使用の出力の集合です。ブロックごとに使った出力を取っておき、再編成で巻き戻せるようにします。
+type utxoSet struct {
+	outputs  map[OutPoint]TxOutput
+	balances map[string]Amount
+	spent    map[[32]byte][]*UTXO // ブロックハッシュごとにそのブロックで使われた出力
+	mux      sync.RWMutex
+}
+
+func newUTXOSet() *utxoSet {
+	return &utxoSet{
+		outputs:  make(map[OutPoint]TxOutput),
+		balances: make(map[string]Amount),
+		spent:    make(map[[32]byte][]*UTXO),
+	}
+}
+
+// clone ブロックを適用せずに検証するための集合のコピーを返します。巻き戻せるよう使った出力の記録もコピーします。
+func (s *utxoSet) clone() *utxoSet {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	c := newUTXOSet()
+	for op, o := range s.outputs {
+		c.outputs[op] = o
+	}
+	for address, balance := range s.balances {
+		c.balances[address] = balance
+	}
+	for hash, spent := range s.spent {
+		c.spent[hash] = spent
+	}
+	return c
+}
+
+func (s *utxoSet) Get(op OutPoint) (TxOutput, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	o, ok := s.outputs[op]
+	return o, ok
+}
+
+func (s *utxoSet) Balance(address string) Amount {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.balances[address]
+}
+
+// Unspent addressの未使用の出力をトランザクションIDと位置の順に返します。
+func (s *utxoSet) Unspent(address string) []*UTXO {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	var utxos []*UTXO
+	for op, o := range s.outputs {
+		if o.Address == address {
+			utxos = append(utxos, &UTXO{OutPoint: op, TxOutput: o})
+		}
+	}
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].TxID != utxos[j].TxID {
+			return utxos[i].TxID < utxos[j].TxID
+		}
+		return utxos[i].Index < utxos[j].Index
+	})
+	return utxos
+}
+
+// checkTransaction 送金トランザクションの入力と出力を検証します。失敗した場合は検証ルールの名前とエラーを返します。
+func (s *utxoSet) checkTransaction(t *Transaction) (string, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.check(t)
+}
+
+func (s *utxoSet) check(t *Transaction) (string, error) {
+	if len(t.Inputs) == 0 {
+		return RuleInput, fmt.Errorf("transaction has no inputs")
+	}
+	if len(t.Outputs) == 0 {
+		return RuleOutput, fmt.Errorf("transaction has no outputs")
+	}
+	if t.Outputs[0].Address != t.RecipientBlockchainAddress || t.Outputs[0].Value != t.Value {
+		return RuleOutput, fmt.Errorf("first output must pay value to the recipient")
+	}
+	var in, out Amount
+	used := make(map[OutPoint]bool, len(t.Inputs))
+	for _, op := range t.Inputs {
+		if used[op] {
+			return RuleInput, fmt.Errorf("input %s is used twice", op)
+		}
+		used[op] = true
+		o, ok := s.outputs[op]
+		if !ok {
+			return RuleInput, fmt.Errorf("input %s is not an unspent output", op)
+		}
+		if o.Address != t.SenderBlockchainAddress {
+			return RuleInput, fmt.Errorf("input %s belongs to %s", op, o.Address)
+		}
+		sum, err := SumAmounts(in, o.Value)
+		if err != nil {
+			return RuleInput, fmt.Errorf("input total %v", err)
+		}
+		in = sum
+	}
+	for _, o := range t.Outputs {
+		if o.Value <= 0 || o.Value > MaxAmount {
+			return RuleOutput, fmt.Errorf("output value %s must be positive and at most %s", o.Value, MaxAmount)
+		}
+		sum, err := SumAmounts(out, o.Value)
+		if err != nil || sum > in {
+			return RuleOutput, fmt.Errorf("outputs spend more than inputs %s", in)
+		}
+		out = sum
+	}
+	if in-out != t.Fee {
+		return RuleFee, fmt.Errorf("inputs %s minus outputs %s do not equal fee %s", in, out, t.Fee)
+	}
+	return "", nil
+}
+
+// applyBlock ブロックのトランザクションを順番に適用します。ブロックは検証済みである必要があります。
+func (s *utxoSet) applyBlock(b *Block) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var spent []*UTXO
+	for _, t := range b.Transactions {
+		spent = append(spent, s.applyTransaction(t)...)
+	}
+	s.spent[b.Hash()] = spent
+}
+
+// applyTransaction 入力を使用済みにして出力を追加し、使った出力を返します。
+func (s *utxoSet) applyTransaction(t *Transaction) []*UTXO {
+	var spent []*UTXO
+	for _, op := range t.Inputs {
+		o := s.outputs[op]
+		spent = append(spent, &UTXO{OutPoint: op, TxOutput: o})
+		delete(s.outputs, op)
+		s.balances[o.Address] -= o.Value
+	}
+	id := t.ID()
+	for i, o := range transactionOutputs(t) {
+		s.outputs[OutPoint{TxID: id, Index: i}] = o
+		s.balances[o.Address] += o.Value
+	}
+	return spent
+}
+
+// revertBlock applyBlockを取り消します。
+func (s *utxoSet) revertBlock(b *Block) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// 同じブロック内で作って使った出力もあるので、先に使った出力を戻してから作った出力を消します。
+	hash := b.Hash()
+	for _, u := range s.spent[hash] {
+		s.outputs[u.OutPoint] = u.TxOutput
+		s.balances[u.Address] += u.Value
+	}
+	delete(s.spent, hash)
+	for _, t := range b.Transactions {
+		id := t.ID()
+		for i, o := range transactionOutputs(t) {
+			delete(s.outputs, OutPoint{TxID: id, Index: i})
+			s.balances[o.Address] -= o.Value
+		}
+	}
+}
+
+// diff 2つの集合を比べ、最初に見つかった違いを返します。
+func (s *utxoSet) diff(other *utxoSet) error {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	other.mux.RLock()
+	defer other.mux.RUnlock()
+	if len(s.outputs) != len(other.outputs) {
+		return fmt.Errorf("unspent outputs: index %d, scan %d", len(s.outputs), len(other.outputs))
+	}
+	for op, o := range s.outputs {
+		if other.outputs[op] != o {
+			return fmt.Errorf("output %s differs", op)
+		}
+	}
+	return nil
+}
+
+// UnspentOutputs addressの未使用の出力のうち、プールのトランザクションがまだ使っていないものを返します。
+func (bc *Blockchain) UnspentOutputs(address string) []*UTXO {
+	if !bc.config.UTXO() {
+		return nil
+	}
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	var utxos []*UTXO
+	for _, u := range bc.utxos.Unspent(address) {
+		if _, ok := bc.pendingInputs[u.OutPoint]; !ok {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos
+}
@@ -0,0 +1,27 @@
+package block
+
+import "encoding/json"
+
+// UTXOResponse Ledgerはチェーンの台帳の方式です。アカウント方式のチェーンではUTXOsは空です。
+type UTXOResponse struct {
+	Ledger string  `json:"ledger"`
+	UTXOs  []*UTXO `json:"utxos"`
+}
+
+func (ur *UTXOResponse) MarshalJSON() ([]byte, error) {
+	ledger := ur.Ledger
+	if ledger == "" {
+		ledger = LedgerAccount
+	}
+	utxos := ur.UTXOs
+	if utxos == nil {
+		utxos = []*UTXO{}
+	}
+	return json.Marshal(struct {
+		Ledger string  `json:"ledger"`
+		UTXOs  []*UTXO `json:"utxos"`
+	}{
+		Ledger: ledger,
+		UTXOs:  utxos,
+	})
+}
@@ -0,0 +1,87 @@
+package block
+
+import "testing"
+
+// fundedUTXOSet aliceに1コインの出力を1つ持つ集合と、その出力を返します。
+func fundedUTXOSet(t *testing.T) (*utxoSet, OutPoint) {
+	t.Helper()
+	s := newUTXOSet()
+	coinbase := NewTransaction(MiningSender, "alice", Coin)
+	s.applyBlock(NewBlock(0, [32]byte{}, 0, []*Transaction{coinbase}))
+	return s, OutPoint{TxID: coinbase.ID(), Index: 0}
+}
+
+func spend(op OutPoint, fee Amount, outputs ...TxOutput) *Transaction {
+	tx := NewTransaction("alice", outputs[0].Address, outputs[0].Value)
+	tx.Fee = fee
+	tx.Inputs = []OutPoint{op}
+	tx.Outputs = outputs
+	return tx
+}
+
+func TestUTXOCheck(t *testing.T) {
+	s, op := fundedUTXOSet(t)
+	big := Amount(1) << 62
+	tests := []struct {
+		name string
+		tx   *Transaction
+		rule string
+	}{
+		{"valid", spend(op, Coin/10, TxOutput{"bob", Coin / 2}, TxOutput{"alice", Coin * 4 / 10}), ""},
+		{"fee mismatch", spend(op, 0, TxOutput{"bob", Coin / 2}), RuleFee},
+		{"outputs exceed inputs", spend(op, 0, TxOutput{"bob", Coin}, TxOutput{"alice", 1}), RuleOutput},
+		{"zero output", spend(op, Coin, TxOutput{"bob", 0}), RuleOutput},
+		{"output above limit", spend(op, 0, TxOutput{"bob", MaxAmount + 1}), RuleOutput},
+		{"outputs wrap around", spend(op, Coin, TxOutput{"bob", big}, TxOutput{"bob", big}, TxOutput{"bob", big}, TxOutput{"bob", big}), RuleOutput},
+		{"unknown input", spend(OutPoint{TxID: "missing"}, 0, TxOutput{"bob", Coin}), RuleInput},
+	}
+	for _, tt := range tests {
+		rule, err := s.check(tt.tx)
+		if rule != tt.rule || (tt.rule == "") != (err == nil) {
+			t.Errorf("%s: got rule %q, %v, want %q", tt.name, rule, err, tt.rule)
+		}
+	}
+
+	double := spend(op, 0, TxOutput{"bob", 2 * Coin})
+	double.Inputs = []OutPoint{op, op}
+	if rule, _ := s.check(double); rule != RuleInput {
+		t.Errorf("input used twice: got rule %q, want %q", rule, RuleInput)
+	}
+	theft := spend(op, 0, TxOutput{"bob", Coin})
+	theft.SenderBlockchainAddress = "mallory"
+	if rule, _ := s.check(theft); rule != RuleInput {
+		t.Errorf("input of another address: got rule %q, want %q", rule, RuleInput)
+	}
+}
+
+func TestUTXOApplyRevert(t *testing.T) {
+	s, op := fundedUTXOSet(t)
+	before, _ := fundedUTXOSet(t)
+
+	pay := spend(op, Coin/10, TxOutput{"bob", Coin / 2}, TxOutput{"alice", Coin * 4 / 10})
+	// 同じブロックで作った出力をすぐに使うトランザクションも入れます
+	onward := spend(OutPoint{TxID: pay.ID(), Index: 1}, 0, TxOutput{"carol", Coin * 4 / 10})
+	reward := NewTransaction(MiningSender, "miner", Coin+Coin/10)
+	reward.Nonce = 1
+	b := NewBlock(0, [32]byte{1}, 0, []*Transaction{reward, pay, onward})
+	s.applyBlock(b)
+
+	for address, want := range map[string]Amount{"alice": 0, "bob": Coin / 2, "carol": Coin * 4 / 10, "miner": Coin + Coin/10} {
+		if got := s.Balance(address); got != want {
+			t.Errorf("balance of %s after apply = %s, want %s", address, got, want)
+		}
+	}
+	if _, ok := s.Get(op); ok {
+		t.Errorf("spent output %s is still unspent", op)
+	}
+
+	s.revertBlock(b)
+	if err := s.diff(before); err != nil {
+		t.Fatalf("revert did not restore the set: %v", err)
+	}
+	for _, address := range []string{"alice", "bob", "carol", "miner"} {
+		if got, want := s.Balance(address), before.Balance(address); got != want {
+			t.Errorf("balance of %s after revert = %s, want %s", address, got, want)
+		}
+	}
+}
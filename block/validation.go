@@ -0,0 +1,282 @@
+package block
+
+import (
+	"blockchain_smp_go/utils"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ValidChainで検査するルールの名前です。ChainValidationError.Ruleに入ります。
+const (
+	RuleEmpty        = "empty_chain"
+	RuleGenesis      = "genesis"
+	RulePreviousHash = "previous_hash"
+	RuleTimestamp    = "timestamp"
+	RuleDifficulty   = "difficulty"
+	RuleMerkleRoot   = "merkle_root"
+	RuleProofOfWork  = "proof_of_work"
+	RuleCoinbase     = "coinbase"
+	RuleReward       = "reward"
+	RuleValue        = "value"
+	RuleBalance      = "balance"
+	RuleSignature    = "signature"
+	RuleSender       = "sender_address"
+	RuleNonce        = "nonce"
+	RuleFee          = "fee"
+	RuleLedger       = "ledger"
+	RuleInput        = "input"
+	RuleOutput       = "output"
+	RuleBlockSize    = "block_size"
+)
+
+// ChainValidationError どのブロックのどのルールで検証に失敗したかを表します。
+type ChainValidationError struct {
+	Height      int
+	Transaction int // トランザクションに関するルールの場合はブロック内の位置、それ以外は-1
+	Rule        string
+	Message     string
+}
+
+func (e *ChainValidationError) Error() string {
+	if e.Transaction >= 0 {
+		return fmt.Sprintf("block %d: transaction %d: %s: %s", e.Height, e.Transaction, e.Rule, e.Message)
+	}
+	return fmt.Sprintf("block %d: %s: %s", e.Height, e.Rule, e.Message)
+}
+
+func blockError(height int, rule string, format string, a ...interface{}) error {
+	return &ChainValidationError{Height: height, Transaction: -1, Rule: rule, Message: fmt.Sprintf(format, a...)}
+}
+
+func transactionError(height int, index int, rule string, format string, a ...interface{}) error {
+	return &ChainValidationError{Height: height, Transaction: index, Rule: rule, Message: fmt.Sprintf(format, a...)}
+}
+
+func (bc *Blockchain) ValidChain(chain []*Block) bool {
+	if err := bc.VerifyChain(chain); err != nil {
+		log.Printf("ERROR: invalid chain: %v", err)
+		return false
+	}
+	return true
+}
+
+// VerifyChain チェーンを最初から再生して全てのルールを検証します。失敗した場合は*ChainValidationErrorを返します。
+func (bc *Blockchain) VerifyChain(chain []*Block) error {
+	if len(chain) == 0 {
+		return blockError(0, RuleEmpty, "chain has no blocks")
+	}
+	if err := bc.verifyGenesis(chain[0]); err != nil {
+		return err
+	}
+
+	state := newAccountState()
+	state.applyBlock(chain[0])
+	var utxos *utxoSet
+	if bc.config.UTXO() {
+		utxos = newUTXOSet()
+	}
+	maxTimestamp := time.Now().Add(MaxFutureBlockTimeSec * time.Second).UnixNano()
+	for height := 1; height < len(chain); height++ {
+		if err := bc.verifyChainBlock(chain, height, maxTimestamp, state, utxos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChainBlock chainの高さheightのブロックを、親までを適用したstate(UTXO方式ではutxos)に対して検証し、適用します。
+func (bc *Blockchain) verifyChainBlock(chain []*Block, height int, maxTimestamp int64, state *accountState, utxos *utxoSet) error {
+	preBlock := chain[height-1]
+	block := chain[height]
+	blockAt := func(height int) *Block {
+		return chain[height]
+	}
+
+	if block.PreviousHash != preBlock.Hash() {
+		return blockError(height, RulePreviousHash, "does not link to block %d", height-1)
+	}
+	if block.Config != nil {
+		return blockError(height, RuleGenesis, "only the genesis block may carry a chain config")
+	}
+	if block.Timestamp <= preBlock.Timestamp {
+		return blockError(height, RuleTimestamp, "timestamp %d is not after parent %d", block.Timestamp, preBlock.Timestamp)
+	}
+	if block.Timestamp > maxTimestamp {
+		return blockError(height, RuleTimestamp, "timestamp %d is too far in the future", block.Timestamp)
+	}
+	if block.MerkleRoot != TransactionsMerkleRoot(block.Transactions) {
+		return blockError(height, RuleMerkleRoot, "merkle root does not match transactions")
+	}
+	if size := transactionsSize(block.Transactions); size > MaxBlockSize {
+		return blockError(height, RuleBlockSize, "transactions are %d bytes, limit is %d", size, MaxBlockSize)
+	}
+	if err := bc.engine.VerifyHeader(blockAt, height, block.Header()); err != nil {
+		return err
+	}
+	if err := bc.verifyBlock(height, block); err != nil {
+		return err
+	}
+	return verifyBlockTransactions(height, block, bc.config.BlockReward(height), state, utxos)
+}
+
+func (bc *Blockchain) verifyGenesis(genesis *Block) error {
+	empty := &Block{}
+	if genesis.PreviousHash != empty.Hash() {
+		return blockError(0, RuleGenesis, "unexpected previous hash %x", genesis.PreviousHash)
+	}
+	if len(genesis.Transactions) != 0 {
+		return blockError(0, RuleGenesis, "genesis block has %d transactions", len(genesis.Transactions))
+	}
+	if genesis.MerkleRoot != TransactionsMerkleRoot(genesis.Transactions) {
+		return blockError(0, RuleMerkleRoot, "merkle root does not match transactions")
+	}
+	if !genesis.Config.Equal(bc.config) {
+		return blockError(0, RuleGenesis, "chain config does not match this node")
+	}
+	return bc.engine.VerifyHeader(func(int) *Block { return nil }, 0, genesis.Header())
+}
+
+// verifyBlockTransactions ブロックのトランザクションをstateに適用しながら検証します。
+// stateは高さheight-1までを適用した状態で、アンボンディングの期間が終わった額を残高に戻してから検証します。
+// utxosがnilでなければUTXO方式のチェーンとして、送金はnonceと残高の代わりに入力と出力で検証し、utxosに適用します。
+func verifyBlockTransactions(height int, block *Block, reward Amount, state *accountState, utxos *utxoSet) error {
+	balances, nonces, stakes := state.balances, state.nonces, state.stakes
+	state.release(height)
+	var fees Amount
+	for i, t := range block.Transactions {
+		if !ValidAmount(t.Fee) {
+			return transactionError(height, i, RuleFee, "fee %s must be between 0 and %s", t.Fee, MaxAmount)
+		}
+		if t.SenderBlockchainAddress != MiningSender {
+			sum, err := SumAmounts(fees, t.Fee)
+			if err != nil {
+				return transactionError(height, i, RuleFee, "total fees %v", err)
+			}
+			fees = sum
+		}
+	}
+
+	coinbase := -1
+	for i, t := range block.Transactions {
+		if t.Value <= 0 || t.Value > MaxAmount {
+			return transactionError(height, i, RuleValue, "value %s must be positive and at most %s", t.Value, MaxAmount)
+		}
+		if t.SenderBlockchainAddress == MiningSender {
+			if t.Signature != nil || t.SenderPublicKey != nil {
+				return transactionError(height, i, RuleCoinbase, "mining reward must not be signed")
+			}
+			if coinbase >= 0 {
+				return transactionError(height, i, RuleCoinbase, "second mining reward (first is transaction %d)", coinbase)
+			}
+			coinbase = i
+			if t.Nonce != uint64(height) {
+				return transactionError(height, i, RuleCoinbase, "mining reward nonce %d, expected block height", t.Nonce)
+			}
+			if t.Fee != 0 {
+				return transactionError(height, i, RuleFee, "mining reward must not pay a fee")
+			}
+			if limit, err := SumAmounts(reward, fees); err != nil || t.Value > limit {
+				return transactionError(height, i, RuleReward, "mining reward %s exceeds %s plus fees %s", t.Value, reward, fees)
+			}
+			if len(t.Inputs) > 0 || len(t.Outputs) > 0 {
+				return transactionError(height, i, RuleCoinbase, "mining reward must not have inputs or outputs")
+			}
+			if err := credit(balances, t.RecipientBlockchainAddress, t.Value); err != nil {
+				return transactionError(height, i, RuleBalance, "%v", err)
+			}
+			if utxos != nil {
+				utxos.applyTransaction(t)
+			}
+			continue
+		}
+		if t.IsSlashing() {
+			if utxos != nil {
+				return transactionError(height, i, RuleLedger, "slashing is only supported by an account ledger")
+			}
+			if t.Signature != nil || t.SenderPublicKey != nil {
+				return transactionError(height, i, RuleSlash, "slashing must not be signed")
+			}
+			offender, err := t.Evidence.Verify()
+			if err != nil {
+				return transactionError(height, i, RuleSlash, "%v", err)
+			}
+			if offender != t.SenderBlockchainAddress {
+				return transactionError(height, i, RuleSlash, "evidence is signed by %s, not %s", offender, t.SenderBlockchainAddress)
+			}
+			if t.Fee != 0 || t.Nonce != 0 {
+				return transactionError(height, i, RuleSlash, "slashing must not have a fee or nonce")
+			}
+			if state.evidence[t.Evidence.ID()] {
+				return transactionError(height, i, RuleSlash, "evidence against %s was already used", offender)
+			}
+			state.slash(height, t)
+			continue
+		}
+		if t.Evidence != nil {
+			return transactionError(height, i, RuleSlash, "only slashing transactions carry evidence")
+		}
+		if !utils.IsAddressOwner(t.SenderPublicKey, t.SenderBlockchainAddress) {
+			return transactionError(height, i, RuleSender, "public key does not own %s", t.SenderBlockchainAddress)
+		}
+		if !t.VerifySignature() {
+			return transactionError(height, i, RuleSignature, "missing or invalid signature from %s", t.SenderBlockchainAddress)
+		}
+		if utxos != nil {
+			if t.IsStake() || t.IsUnstake() {
+				return transactionError(height, i, RuleLedger, "staking is only supported by an account ledger")
+			}
+			if rule, err := utxos.check(t); err != nil {
+				return transactionError(height, i, rule, "%v", err)
+			}
+			utxos.applyTransaction(t)
+			continue
+		}
+		if len(t.Inputs) > 0 || len(t.Outputs) > 0 {
+			return transactionError(height, i, RuleLedger, "inputs and outputs are only used by a UTXO ledger")
+		}
+		if t.Nonce != nonces[t.SenderBlockchainAddress] {
+			return transactionError(height, i, RuleNonce, "nonce %d, expected %d", t.Nonce, nonces[t.SenderBlockchainAddress])
+		}
+		nonces[t.SenderBlockchainAddress]++
+		if t.IsUnstake() {
+			if stakes[t.SenderBlockchainAddress] < t.Value {
+				return transactionError(height, i, RuleStake, "%s unstakes %s but has a stake of %s",
+					t.SenderBlockchainAddress, t.Value, stakes[t.SenderBlockchainAddress])
+			}
+			if balances[t.SenderBlockchainAddress] < t.Fee {
+				return transactionError(height, i, RuleBalance, "%s pays fee %s but has %s",
+					t.SenderBlockchainAddress, t.Fee, balances[t.SenderBlockchainAddress])
+			}
+			balances[t.SenderBlockchainAddress] -= t.Fee
+			state.unbond(height, t.SenderBlockchainAddress, t.Value)
+			continue
+		}
+		if balances[t.SenderBlockchainAddress] < t.Value+t.Fee {
+			return transactionError(height, i, RuleBalance, "%s spends %s plus fee %s but has %s",
+				t.SenderBlockchainAddress, t.Value, t.Fee, balances[t.SenderBlockchainAddress])
+		}
+		balances[t.SenderBlockchainAddress] -= t.Value + t.Fee
+		if t.IsStake() {
+			if err := credit(stakes, t.SenderBlockchainAddress, t.Value); err != nil {
+				return transactionError(height, i, RuleStake, "%v", err)
+			}
+			continue
+		}
+		if err := credit(balances, t.RecipientBlockchainAddress, t.Value); err != nil {
+			return transactionError(height, i, RuleBalance, "%v", err)
+		}
+	}
+	state.height = height
+	return nil
+}
+
+// credit addressの残高(またはステーク)にvalueを加えます。int64の範囲を超える場合は加えずにエラーを返します。
+func credit(balances map[string]Amount, address string, value Amount) error {
+	sum, err := SumAmounts(balances[address], value)
+	if err != nil {
+		return fmt.Errorf("%s receives %s: %v", address, value, err)
+	}
+	balances[address] = sum
+	return nil
+}
@@ -0,0 +1,41 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBlockSizeLimit ブロックに入りきらないトランザクションは次のブロックに回り、MaxBlockSizeを超えるブロックは無効になることを確認します。
+func TestBlockSizeLimit(t *testing.T) {
+	key, alice := newTestKey(t)
+	bc := newTestBlockchain(t, alice)
+	var pool []*Transaction
+	for nonce := uint64(0); transactionsSize(pool) <= MaxBlockSize; nonce++ {
+		tx := signedTransfer(t, key, "bob", 1, 0, nonce)
+		if !bc.AddSignedTransaction(tx) {
+			t.Fatalf("transaction %d was rejected", nonce)
+		}
+		pool = append(pool, tx)
+	}
+	if !bc.Mining() {
+		t.Fatal("mining failed")
+	}
+	mined := bc.LastBlock()
+	if size := transactionsSize(mined.Transactions); size > MaxBlockSize {
+		t.Fatalf("mined a block of %d bytes", size)
+	}
+	if len(bc.TransactionPool()) == 0 {
+		t.Fatal("all transactions fit in one block")
+	}
+	chain := bc.Chain()
+	if err := bc.VerifyChain(chain); err != nil {
+		t.Fatal(err)
+	}
+
+	oversized := NewBlock(0, mined.Hash(), 0, pool)
+	oversized.Timestamp = time.Now().UnixNano()
+	err := bc.VerifyChain(append(chain, oversized))
+	if cve, ok := err.(*ChainValidationError); !ok || cve.Rule != RuleBlockSize {
+		t.Fatalf("oversized block: got %v, want rule %s", err, RuleBlockSize)
+	}
+}
@@ -4,32 +4,58 @@ import (
 	"blockchain_smp_go/block"
 	"blockchain_smp_go/utils"
 	"blockchain_smp_go/wallet"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var cache = make(map[string]*block.Blockchain)
 
+// NodeKeyFile datadirに保存するノードの鍵のファイル名です。
+const NodeKeyFile = "node_key.json"
+
 type BlockchainServer struct {
-	port uint16
+	port         uint16
+	dataDir      string
+	config       *block.ChainConfig
+	workers      int
+	blockLimiter *peerLimiter // POST /blocksの送信元ごとの制限
 }
 
-func NewBlockchainServer(port uint16) *BlockchainServer {
-	return &BlockchainServer{port}
+func NewBlockchainServer(port uint16, dataDir string, config *block.ChainConfig, workers int) *BlockchainServer {
+	return &BlockchainServer{port, dataDir, config, workers, newPeerLimiter(BlocksPerPeerPerMinute, time.Minute)}
 }
 
 func (bcs *BlockchainServer) Port() uint16 {
 	return bcs.port
 }
 
+func (bcs *BlockchainServer) DataDir() string {
+	return bcs.dataDir
+}
+
 func (bcs *BlockchainServer) GetBlockchain() *block.Blockchain {
 	bc, ok := cache["blockchain"]
 	if !ok {
-		minersWallet := wallet.NewWallet()
-		bc = block.NewBlockchain(minersWallet.BlockchainAddress(), bcs.Port())
+		// ノードの鍵はdatadirに保存し、再起動しても同じアドレスでブロックを作れるようにします
+		minersWallet, err := wallet.LoadOrCreateWallet(filepath.Join(bcs.DataDir(), NodeKeyFile))
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		bc, err = block.LoadBlockchain(minersWallet.BlockchainAddress(), bcs.Port(), bcs.DataDir(), bcs.config)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		bc.SetMiningWorkers(bcs.workers)
+		bc.SetSigner(minersWallet.PrivateKey())
 		cache["blockchain"] = bc
 		log.Printf("private_key %v", minersWallet.PrivateKeyString())
 		log.Printf("publick_key %v", minersWallet.PublicKeyString())
@@ -80,11 +106,9 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
-		signature := utils.SignatureFromString(*t.Signature)
+		transaction := t.Transaction()
 		bc := bcs.GetBlockchain()
-		isCreated := bc.CreateTransaction(*t.SenderBlockchainAddress,
-			*t.RecipientBlockchainAddress, *t.Value, publicKey, signature)
+		isCreated := bc.CreateSignedTransaction(transaction)
 
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
@@ -93,7 +117,13 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			m = utils.JsonStatus("fail")
 		} else {
 			w.WriteHeader(http.StatusCreated)
-			m = utils.JsonStatus("success")
+			m, _ = json.Marshal(struct {
+				Message string `json:"message"`
+				ID      string `json:"id"`
+			}{
+				Message: "success",
+				ID:      transaction.ID(),
+			})
 		}
 		io.WriteString(w, string(m))
 	case http.MethodPut:
@@ -110,11 +140,8 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
-		signature := utils.SignatureFromString(*t.Signature)
 		bc := bcs.GetBlockchain()
-		isUpdated := bc.AddTransaction(*t.SenderBlockchainAddress,
-			*t.RecipientBlockchainAddress, *t.Value, publicKey, signature)
+		isUpdated := bc.AddSignedTransaction(t.Transaction())
 
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
@@ -127,10 +154,6 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 		}
 		io.WriteString(w, string(m))
 
-	case http.MethodDelete:
-		bc := bcs.GetBlockchain()
-		bc.ClearTransactionPool()
-		io.WriteString(w, string(utils.JsonStatus("success")))
 	default:
 		log.Println("ERROR: Invalid HTTP Method")
 		w.WriteHeader(http.StatusBadRequest)
@@ -174,13 +197,31 @@ func (bcs *BlockchainServer) StartMine(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// MineStatus GET /mine/status マイニング中か、ワーカー数とハッシュレートを返します。
+func (bcs *BlockchainServer) MineStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		m, _ := bcs.GetBlockchain().MiningStatus().MarshalJSON()
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Amount(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
 		blockchainAddress := req.URL.Query().Get("blockchain_address")
-		amount := bcs.GetBlockchain().CalculateTotalAmount(blockchainAddress)
+		bc := bcs.GetBlockchain()
 
-		ar := &block.AmountResponse{Amount: amount}
+		ar := &block.AmountResponse{
+			Amount:    bc.CalculateTotalAmount(blockchainAddress),
+			Available: bc.AvailableAmount(blockchainAddress),
+			Pending:   bc.PendingAmount(blockchainAddress),
+		}
 		m, _ := ar.MarshalJSON()
 
 		w.Header().Add("Content-Type", "application/json")
@@ -192,24 +233,314 @@ func (bcs *BlockchainServer) Amount(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Nonce 未承認のトランザクションも含めて、アドレスが次の送金で使うnonceを返します。
+func (bcs *BlockchainServer) Nonce(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		blockchainAddress := req.URL.Query().Get("blockchain_address")
+		nonce := bcs.GetBlockchain().NextNonce(blockchainAddress)
+
+		m, _ := json.Marshal(struct {
+			Nonce uint64 `json:"nonce"`
+		}{
+			Nonce: nonce,
+		})
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// UTXOs GET /utxos?blockchain_address= アドレスの未使用の出力のうち、プールのトランザクションが使っていないものを返します。
+func (bcs *BlockchainServer) UTXOs(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		blockchainAddress := req.URL.Query().Get("blockchain_address")
+		bc := bcs.GetBlockchain()
+
+		ur := &block.UTXOResponse{Ledger: bc.Config().Ledger, UTXOs: bc.UnspentOutputs(blockchainAddress)}
+		m, _ := ur.MarshalJSON()
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Supply GET /supply 発行された量と現在のマイニング報酬を返します。
+func (bcs *BlockchainServer) Supply(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		m, _ := bcs.GetBlockchain().Supply().MarshalJSON()
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Stakes GET /stakes ステークを持つアドレスとその額を返します。
+func (bcs *BlockchainServer) Stakes(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		sr := &block.StakesResponse{Stakes: bcs.GetBlockchain().Stakes()}
+		m, _ := sr.MarshalJSON()
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Evidence 二重署名の証拠(同じ親に続く2つのヘッダー)を受け取り、署名者をスラッシングするトランザクションをプールに追加します。
+// POSTは隣接ノードにも送り、PUTは隣接ノードから送られたものを追加するだけです。
+func (bcs *BlockchainServer) Evidence(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut:
+		decoder := json.NewDecoder(req.Body)
+		var evidence block.DoubleSignEvidence
+		if err := decoder.Decode(&evidence); err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		bc := bcs.GetBlockchain()
+		var err error
+		if req.Method == http.MethodPost {
+			err = bc.ReportDoubleSign(&evidence)
+		} else {
+			err = bc.AddDoubleSignEvidence(&evidence)
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, string(utils.JsonStatus("success")))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// BFTProposal POST /bft/proposal 隣接ノードのバリデーターからの提案を受け取ります。
+func (bcs *BlockchainServer) BFTProposal(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		decoder := json.NewDecoder(req.Body)
+		var p block.Proposal
+		err := decoder.Decode(&p)
+		if err == nil {
+			err = bcs.GetBlockchain().ReceiveProposal(&p)
+		}
+		bcs.writeBFTResult(w, err)
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// BFTVote POST /bft/vote 隣接ノードのバリデーターからのプレボートとプレコミットを受け取ります。
+func (bcs *BlockchainServer) BFTVote(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		decoder := json.NewDecoder(req.Body)
+		var v block.Vote
+		err := decoder.Decode(&v)
+		if err == nil {
+			err = bcs.GetBlockchain().ReceiveVote(&v)
+		}
+		bcs.writeBFTResult(w, err)
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (bcs *BlockchainServer) writeBFTResult(w http.ResponseWriter, err error) {
+	w.Header().Add("Content-Type", "application/json")
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return
+	}
+	io.WriteString(w, string(utils.JsonStatus("success")))
+}
+
+// BFTStatus GET /bft/status 今の高さとラウンド、集まった投票の数を返します。
+func (bcs *BlockchainServer) BFTStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		status, err := bcs.GetBlockchain().BFTStatus()
+		if err != nil {
+			bcs.writeBFTResult(w, err)
+			return
+		}
+		m, _ := status.MarshalJSON()
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Blocks POST /blocks 隣接ノードから1つのブロックを受け取ってブロックの木に追加します。
+// 親がまだない場合は孤立ブロックとして保持し、隣接ノードのチェーンを取得して親を探します。
+// 送信元ごとに1分間にBlocksPerPeerPerMinuteまでしか受け付けません。
+func (bcs *BlockchainServer) Blocks(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		if !bcs.blockLimiter.Allow(req.RemoteAddr) {
+			log.Printf("ERROR: too many blocks from %s", req.RemoteAddr)
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		decoder := json.NewDecoder(req.Body)
+		var b block.Block
+		if err := decoder.Decode(&b); err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		bc := bcs.GetBlockchain()
+		err := bc.ReceiveBlock(&b)
+
+		w.Header().Add("Content-Type", "application/json")
+		if errors.Is(err, block.ErrOrphanBlock) {
+			go bc.ResolveOrphans()
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, string(utils.JsonStatus("orphan")))
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, string(utils.JsonStatus("success")))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Tips GET /tips ブロックの木にある全てのチェーンの末尾(自ノードのチェーンとサイドチェーン)と孤立ブロックを返します。
+func (bcs *BlockchainServer) Tips(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		bc := bcs.GetBlockchain()
+		tr := &block.TipsResponse{Tips: bc.Tips(), Orphans: bc.Orphans()}
+		m, _ := tr.MarshalJSON()
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Consensus(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodPut:
 		bc := bcs.GetBlockchain()
-		replaced := bc.ResolveConflicts()
+		result := bc.ResolveConflicts()
 
 		w.Header().Add("Content-Type", "application/json")
-		if replaced {
-			io.WriteString(w, string(utils.JsonStatus("success")))
-		} else {
+		m, _ := result.MarshalJSON()
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+}
+
+// Tx /tx/{id} でトランザクションの状態(プールで待機中か、どのブロックに含まれたか)を、
+// /tx/{id}/proof でマークルプルーフとブロックヘッダーを返します。
+func (bcs *BlockchainServer) Tx(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/tx/"), "/"), "/")
+		id, err := parseTxID(parts[0])
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
 			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
 
+		bc := bcs.GetBlockchain()
+		var m []byte
+		switch {
+		case len(parts) == 1:
+			status, err := bc.FindTransaction(id)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			m, _ = status.MarshalJSON()
+		case len(parts) == 2 && parts[1] == "proof":
+			proof, err := bc.TransactionProof(id)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			m, _ = proof.MarshalJSON()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
 		}
+		io.WriteString(w, string(m))
 	default:
 		log.Println("ERROR: Invalid HTTP Method")
 		w.WriteHeader(http.StatusBadRequest)
 	}
+}
 
+func parseTxID(id string) (string, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != 32 {
+		return "", fmt.Errorf("invalid transaction id %q", id)
+	}
+	return fmt.Sprintf("%x", b), nil
 }
 
 func (bcs *BlockchainServer) Run() {
@@ -219,7 +550,19 @@ func (bcs *BlockchainServer) Run() {
 	http.HandleFunc("/transactions", bcs.Transactions)
 	http.HandleFunc("/mine", bcs.Mine)
 	http.HandleFunc("/mine/start", bcs.StartMine)
+	http.HandleFunc("/mine/status", bcs.MineStatus)
 	http.HandleFunc("/amount", bcs.Amount)
+	http.HandleFunc("/nonce", bcs.Nonce)
+	http.HandleFunc("/utxos", bcs.UTXOs)
+	http.HandleFunc("/supply", bcs.Supply)
+	http.HandleFunc("/stakes", bcs.Stakes)
+	http.HandleFunc("/evidence", bcs.Evidence)
+	http.HandleFunc("/bft/proposal", bcs.BFTProposal)
+	http.HandleFunc("/bft/vote", bcs.BFTVote)
+	http.HandleFunc("/bft/status", bcs.BFTStatus)
+	http.HandleFunc("/blocks", bcs.Blocks)
+	http.HandleFunc("/tips", bcs.Tips)
 	http.HandleFunc("/consensus", bcs.Consensus)
+	http.HandleFunc("/tx/", bcs.Tx)
 	log.Fatal(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(int(bcs.Port())), nil))
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// BlocksPerPeerPerMinute POST /blocksで1つの送信元から1分間に受け付けるブロックの数です。
+const BlocksPerPeerPerMinute = 60
+
+// peerLimiter 送信元のホストごとに、windowの間に受け付けるリクエストの数をlimitまでに制限します。
+type peerLimiter struct {
+	limit   int
+	window  time.Duration
+	windows map[string]*peerWindow
+	mux     sync.Mutex
+}
+
+// peerWindow 送信元の1つの期間の始まりと、その間に受け付けた数です。
+type peerWindow struct {
+	start time.Time
+	count int
+}
+
+func newPeerLimiter(limit int, window time.Duration) *peerLimiter {
+	return &peerLimiter{limit: limit, window: window, windows: make(map[string]*peerWindow)}
+}
+
+// Allow remoteAddr(http.Request.RemoteAddr)からのリクエストを受け付けてよいか返します。
+func (pl *peerLimiter) Allow(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	pl.mux.Lock()
+	defer pl.mux.Unlock()
+	now := time.Now()
+	for h, w := range pl.windows {
+		if now.Sub(w.start) >= pl.window {
+			delete(pl.windows, h)
+		}
+	}
+	w, ok := pl.windows[host]
+	if !ok {
+		w = &peerWindow{start: now}
+		pl.windows[host] = w
+	}
+	if w.count >= pl.limit {
+		return false
+	}
+	w.count++
+	return true
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerLimiter(t *testing.T) {
+	pl := newPeerLimiter(2, time.Minute)
+	for i := 0; i < 2; i++ {
+		if !pl.Allow("10.0.0.1:5000") {
+			t.Fatalf("request %d was refused", i)
+		}
+	}
+	// ポートが違っても同じホストとして数えます
+	if pl.Allow("10.0.0.1:5001") {
+		t.Error("third request from the same host was allowed")
+	}
+	if !pl.Allow("10.0.0.2:5000") {
+		t.Error("request from another host was refused")
+	}
+
+	pl.windows["10.0.0.1"].start = time.Now().Add(-time.Minute)
+	if !pl.Allow("10.0.0.1:5000") {
+		t.Error("request was refused after the window ended")
+	}
+}
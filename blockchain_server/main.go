@@ -1,9 +1,14 @@
 package main
 
 import (
+	"blockchain_smp_go/block"
+	"blockchain_smp_go/wallet"
 	"flag"
 	"fmt"
 	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func init() {
@@ -12,8 +17,80 @@ func init() {
 
 func main() {
 	port := flag.Uint("port", 5001, "port number for blockchain server")
+	dataDir := flag.String("datadir", "", "data directory for the chain (default: data/<port>)")
+	blockTime := flag.Int64("blocktime", block.TargetBlockTimeSec, "target block interval in seconds for a new chain")
+	retarget := flag.Int("retarget", block.RetargetInterval, "difficulty retarget interval in blocks for a new chain")
+	halving := flag.Int("halving", block.HalvingInterval, "mining reward halving interval in blocks for a new chain (0 disables halving)")
+	maxSupply := flag.String("maxsupply", block.MaxSupply.String(), "cap on coins issued by mining rewards for a new chain (0 disables the cap)")
+	workers := flag.Int("workers", 0, "number of proof-of-work goroutines (default: number of CPUs)")
+	consensus := flag.String("consensus", block.ConsensusPoW, "consensus engine for a new chain")
+	authorities := flag.String("authorities", "", "comma-separated authority (poa) or validator (bft) addresses for a new chain")
+	period := flag.Int64("period", block.DefaultBlockPeriodSec, "block period in seconds for a new poa, pos or bft chain")
+	stake := flag.String("stake", "", "comma-separated address=amount genesis stakes for a new proof-of-stake chain")
+	ledger := flag.String("ledger", block.LedgerAccount, "ledger model for a new chain (account or utxo)")
+	showKey := flag.Bool("showkey", false, "print the node's blockchain address (creating its key in the datadir) and exit")
 	flag.Parse()
+	if *dataDir == "" {
+		*dataDir = filepath.Join("data", strconv.Itoa(int(*port)))
+	}
+	// PoAのオーソリティやBFTのバリデーターを決めるため、チェーンを作る前にノードのアドレスを確認できるようにします
+	if *showKey {
+		w, err := wallet.LoadOrCreateWallet(filepath.Join(*dataDir, NodeKeyFile))
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		fmt.Println(w.BlockchainAddress())
+		return
+	}
 	fmt.Printf("portは%dです\n", *port)
-	app := NewBlockchainServer(uint16(*port))
+	fmt.Printf("datadirは%sです\n", *dataDir)
+	config := block.DefaultChainConfig()
+	config.TargetBlockTimeSec = *blockTime
+	config.RetargetInterval = *retarget
+	config.HalvingInterval = *halving
+	supply, err := block.ParseAmount(*maxSupply)
+	if err != nil {
+		log.Fatalf("ERROR: -maxsupply: %v", err)
+	}
+	config.MaxSupply = supply
+	if *consensus != block.ConsensusPoW {
+		config.Consensus = *consensus
+	}
+	if *consensus == block.ConsensusPoA || *consensus == block.ConsensusBFT {
+		for _, a := range strings.Split(*authorities, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				config.Authorities = append(config.Authorities, a)
+			}
+		}
+		config.BlockPeriodSec = *period
+	}
+	if *consensus == block.ConsensusPoS {
+		config.GenesisStake = make(map[string]block.Amount)
+		for _, s := range strings.Split(*stake, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			pair := strings.SplitN(s, "=", 2)
+			if len(pair) != 2 {
+				log.Fatalf("ERROR: -stake: %q is not address=amount", s)
+			}
+			amount, err := block.ParseAmount(pair[1])
+			if err != nil || amount <= 0 {
+				log.Fatalf("ERROR: -stake: invalid amount %q", pair[1])
+			}
+			config.GenesisStake[pair[0]] = amount
+		}
+		config.BlockPeriodSec = *period
+	}
+	if *ledger != block.LedgerAccount {
+		config.Ledger = *ledger
+	}
+	if !config.ValidLedger() {
+		log.Fatalf("ERROR: unknown ledger %q", *ledger)
+	}
+	if _, err := block.NewConsensus(config); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	app := NewBlockchainServer(uint16(*port), *dataDir, config, *workers)
 	app.Run()
 }
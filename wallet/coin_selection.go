@@ -0,0 +1,32 @@
+package wallet
+
+import (
+	"blockchain_smp_go/block"
+	"errors"
+	"sort"
+)
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// SelectCoins 金額の大きい出力から順に、target以上になるまで選びます。選んだ出力とお釣りの額を返します。
+func SelectCoins(unspent []*block.UTXO, target block.Amount) ([]*block.UTXO, block.Amount, error) {
+	candidates := make([]*block.UTXO, len(unspent))
+	copy(candidates, unspent)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Value > candidates[j].Value
+	})
+
+	var selected []*block.UTXO
+	var total block.Amount
+	for _, u := range candidates {
+		if total >= target {
+			break
+		}
+		selected = append(selected, u)
+		total += u.Value
+	}
+	if total < target {
+		return nil, 0, ErrInsufficientFunds
+	}
+	return selected, total - target, nil
+}
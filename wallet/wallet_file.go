@@ -0,0 +1,61 @@
+package wallet
+
+import (
+	"blockchain_smp_go/utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// NewWalletFromPrivateKey 16進数の秘密鍵からウォレットを復元します。
+func NewWalletFromPrivateKey(s string) (*Wallet, error) {
+	d, ok := new(big.Int).SetString(s, 16)
+	if !ok || d.Sign() <= 0 || d.Cmp(elliptic.P256().Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	privateKey := &ecdsa.PrivateKey{D: d}
+	privateKey.PublicKey.Curve = elliptic.P256()
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = elliptic.P256().ScalarBaseMult(d.Bytes())
+	return &Wallet{
+		privateKey:        privateKey,
+		publicKey:         &privateKey.PublicKey,
+		blockchianAddress: utils.AddressFromPublicKey(&privateKey.PublicKey),
+	}, nil
+}
+
+// LoadOrCreateWallet pathのファイルからウォレットを読み込みます。ファイルがなければ新しく作って保存します。
+// ノードの鍵(PoAのオーソリティなど)を再起動後も同じにするために使います。
+func LoadOrCreateWallet(path string) (*Wallet, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		w := NewWallet()
+		m, err := w.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, m, 0o600); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v struct {
+		PrivateKey *string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v.PrivateKey == nil {
+		return nil, fmt.Errorf("%s: missing private_key", path)
+	}
+	return NewWalletFromPrivateKey(*v.PrivateKey)
+}
@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"blockchain_smp_go/block"
 	"blockchain_smp_go/utils"
 	"crypto/ecdsa"
 	"crypto/rand"
@@ -13,11 +14,42 @@ type Transaction struct {
 	senderPublicKey            *ecdsa.PublicKey
 	senderBlockchainAddress    string
 	recipientBlockchainAddress string
-	value                      float32
+	value                      block.Amount
+	fee                        block.Amount
+	nonce                      uint64
+	inputs                     []block.OutPoint
+	outputs                    []block.TxOutput
 }
 
-func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender string, recipient string, value float32) *Transaction {
-	return &Transaction{senderPrivateKey: privateKey, senderPublicKey: publicKey, senderBlockchainAddress: sender, recipientBlockchainAddress: recipient, value: value}
+func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender string, recipient string, value block.Amount, fee block.Amount, nonce uint64) *Transaction {
+	return &Transaction{senderPrivateKey: privateKey, senderPublicKey: publicKey, senderBlockchainAddress: sender, recipientBlockchainAddress: recipient, value: value, fee: fee, nonce: nonce}
+}
+
+// NewUTXOTransaction UTXO方式のチェーン向けに、unspentから入力を選んでトランザクションを作成します。
+// 出力は受取人へのvalueと、残りがあれば送信者へのお釣りです。
+func NewUTXOTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender string, recipient string, value block.Amount, fee block.Amount, nonce uint64,
+	unspent []*block.UTXO) (*Transaction, error) {
+	selected, change, err := SelectCoins(unspent, value+fee)
+	if err != nil {
+		return nil, err
+	}
+	t := NewTransaction(privateKey, publicKey, sender, recipient, value, fee, nonce)
+	for _, u := range selected {
+		t.inputs = append(t.inputs, u.OutPoint)
+	}
+	t.outputs = []block.TxOutput{{Address: recipient, Value: value}}
+	if change > 0 {
+		t.outputs = append(t.outputs, block.TxOutput{Address: sender, Value: change})
+	}
+	return t, nil
+}
+
+func (t *Transaction) Inputs() []block.OutPoint {
+	return t.inputs
+}
+
+func (t *Transaction) Outputs() []block.TxOutput {
+	return t.outputs
 }
 
 func (t *Transaction) GenerateSignature() *utils.Signature {
@@ -35,13 +67,21 @@ func (t *Transaction) GenerateSignature() *utils.Signature {
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`
-		Recipient string  `json:"recipient_blockchain_address"`
-		Value     float32 `json:"value"`
+		Sender    string           `json:"sender_blockchain_address"`
+		Recipient string           `json:"recipient_blockchain_address"`
+		Value     block.Amount     `json:"value"`
+		Fee       block.Amount     `json:"fee"`
+		Nonce     uint64           `json:"nonce"`
+		Inputs    []block.OutPoint `json:"inputs,omitempty"`
+		Outputs   []block.TxOutput `json:"outputs,omitempty"`
 	}{
 		Sender:    t.senderBlockchainAddress,
 		Recipient: t.recipientBlockchainAddress,
 		Value:     t.value,
+		Fee:       t.fee,
+		Nonce:     t.nonce,
+		Inputs:    t.inputs,
+		Outputs:   t.outputs,
 	})
 }
 
@@ -51,6 +91,7 @@ type TransactionRequest struct {
 	RecipientBlockChainAddress *string `json:"recipient_blockchain_address"`
 	SenderPublicKey            *string `json:"sender_public_key"`
 	Value                      *string `json:"value"`
+	Fee                        *string `json:"fee"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
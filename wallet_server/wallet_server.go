@@ -82,17 +82,50 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, req *http.Reque
 
 		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
 		privateKey := utils.PrivateKeyFromString(*t.SenderPrivateKey, publicKey)
-		value, err := strconv.ParseFloat(*t.Value, 32)
+		value, err := block.ParseAmount(*t.Value)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		var fee block.Amount
+		if t.Fee != nil && *t.Fee != "" {
+			fee, err = block.ParseAmount(*t.Fee)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+		}
+
+		nonce, err := ws.fetchNonce(*t.SenderBlockChainAddress)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		utxos, err := ws.fetchUTXOs(*t.SenderBlockChainAddress)
 		if err != nil {
 			log.Printf("ERROR: %v", err)
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		value32 := float32(value)
 
 		w.Header().Add("Content-Type", "application/json")
 
-		transaction := wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockChainAddress, *t.RecipientBlockChainAddress, value32)
+		var transaction *wallet.Transaction
+		if utxos.Ledger == block.LedgerUTXO {
+			transaction, err = wallet.NewUTXOTransaction(privateKey, publicKey, *t.SenderBlockChainAddress, *t.RecipientBlockChainAddress, value, fee, nonce, utxos.UTXOs)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+		} else {
+			transaction = wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockChainAddress, *t.RecipientBlockChainAddress, value, fee, nonce)
+		}
 		signature := transaction.GenerateSignature()
 		signatureStr := signature.String()
 
@@ -100,9 +133,16 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, req *http.Reque
 			SenderBlockchainAddress:    t.SenderBlockChainAddress,
 			RecipientBlockchainAddress: t.RecipientBlockChainAddress,
 			SenderPublicKey:            t.SenderPublicKey,
-			Value:                      &value32,
+			Value:                      &value,
+			Fee:                        &fee,
+			Nonce:                      &nonce,
 			Signature:                  &signatureStr,
 		}
+		if inputs := transaction.Inputs(); len(inputs) > 0 {
+			outputs := transaction.Outputs()
+			bt.Inputs = &inputs
+			bt.Outputs = &outputs
+		}
 		m, _ := json.Marshal(bt)
 		buf := bytes.NewBuffer(m)
 
@@ -112,8 +152,22 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, req *http.Reque
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
+		defer resp.Body.Close()
 		if resp.StatusCode == 201 {
-			io.WriteString(w, string(utils.JsonStatus("success")))
+			var result struct {
+				ID string `json:"id"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+			m, _ := json.Marshal(struct {
+				Message string `json:"message"`
+				ID      string `json:"id"`
+			}{
+				Message: "success",
+				ID:      result.ID,
+			})
+			io.WriteString(w, string(m))
 		} else {
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 
@@ -125,6 +179,67 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, req *http.Reque
 	}
 }
 
+// fetchNonce ブロックチェーンサーバーからアドレスが次に使うnonceを取得します。
+func (ws *WalletServer) fetchNonce(blockchainAddress string) (uint64, error) {
+	endpoint := fmt.Sprintf("%s/nonce", ws.Gateway())
+	bcsReq, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	q := bcsReq.URL.Query()
+	q.Add("blockchain_address", blockchainAddress)
+	bcsReq.URL.RawQuery = q.Encode()
+
+	client := &http.Client{}
+	bcsResp, err := client.Do(bcsReq)
+	if err != nil {
+		return 0, err
+	}
+	defer bcsResp.Body.Close()
+	if bcsResp.StatusCode != 200 {
+		return 0, fmt.Errorf("nonce: %s", bcsResp.Status)
+	}
+
+	var nr struct {
+		Nonce *uint64 `json:"nonce"`
+	}
+	if err := json.NewDecoder(bcsResp.Body).Decode(&nr); err != nil {
+		return 0, err
+	}
+	if nr.Nonce == nil {
+		return 0, fmt.Errorf("nonce: missing field")
+	}
+	return *nr.Nonce, nil
+}
+
+// fetchUTXOs ブロックチェーンサーバーからチェーンの台帳の方式とアドレスの未使用の出力を取得します。
+func (ws *WalletServer) fetchUTXOs(blockchainAddress string) (*block.UTXOResponse, error) {
+	endpoint := fmt.Sprintf("%s/utxos", ws.Gateway())
+	bcsReq, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := bcsReq.URL.Query()
+	q.Add("blockchain_address", blockchainAddress)
+	bcsReq.URL.RawQuery = q.Encode()
+
+	client := &http.Client{}
+	bcsResp, err := client.Do(bcsReq)
+	if err != nil {
+		return nil, err
+	}
+	defer bcsResp.Body.Close()
+	if bcsResp.StatusCode != 200 {
+		return nil, fmt.Errorf("utxos: %s", bcsResp.Status)
+	}
+
+	var ur block.UTXOResponse
+	if err := json.NewDecoder(bcsResp.Body).Decode(&ur); err != nil {
+		return nil, err
+	}
+	return &ur, nil
+}
+
 func (ws *WalletServer) WalletAmount(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -160,11 +275,15 @@ func (ws *WalletServer) WalletAmount(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 			m, _ := json.Marshal(struct {
-				Message string  `json:"message"`
-				Amount  float32 `json:"amount"`
+				Message   string       `json:"message"`
+				Amount    block.Amount `json:"amount"`
+				Available block.Amount `json:"available_amount"`
+				Pending   block.Amount `json:"pending_amount"`
 			}{
-				Message: "success",
-				Amount:  bar.Amount,
+				Message:   "success",
+				Amount:    bar.Amount,
+				Available: bar.Available,
+				Pending:   bar.Pending,
 			})
 			io.WriteString(w, string(m[:]))
 		} else {